@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runBackfill implements `cloudflare-exporter backfill`: it replays historical
+// analytics through the regular fetch and accumulation path and writes the
+// resulting series as OpenMetrics text with explicit timestamps, suitable for
+// `promtool tsdb create-blocks-from openmetrics`.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := fs.String("from", "", "start of the backfill range (RFC 3339, required)")
+	to := fs.String("to", "", "end of the backfill range (RFC 3339, default and at most: SCRAPE_DELAY ago)")
+	step := fs.Duration("step", time.Hour, "window per query and sample interval")
+	datasetNames := fs.String("datasets", "", "comma-separated datasets to backfill (default: all hourly datasets)")
+	output := fs.String("output", "-", "output file, - for stdout")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+	// Backfill is not bound by a scrape timeout: wait for budget instead of
+	// deferring queries
+	cfg.APIBudgetMaxWait = 0
+
+	datasets, err := backfillDatasets(cfg.Datasets, splitList(*datasetNames))
+	if err != nil {
+		return err
+	}
+	if err := checkStep(datasets, *step); err != nil {
+		return err
+	}
+	delay := time.Duration(cfg.ScrapeDelay) * time.Second
+	start, end, err := backfillRange(*from, *to, *step, delay, time.Now())
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	b := &backfiller{
+		collector: NewCloudflareCollector(cfg),
+		datasets:  datasets,
+		families:  make(map[string]*dto.MetricFamily),
+	}
+	for _, t := range b.collector.targets {
+		slog.Info("backfill", "scope", t.scope, "id", t.id, windowAttr(start, end))
+		if err := b.run(t, start, end, *step); err != nil {
+			return fmt.Errorf("%s %s: %w", t.scope, t.id, err)
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	if err := b.write(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// backfillRange parses the backfill range and aligns it to step. The end is
+// capped at delay before now, like the live collector waits for hours and
+// days to settle, so the last step isn't written from incomplete data.
+func backfillRange(from, to string, step, delay time.Duration, now time.Time) (start, end time.Time, err error) {
+	if from == "" {
+		return start, end, fmt.Errorf("--from is required")
+	}
+	if start, err = time.Parse(time.RFC3339, from); err != nil {
+		return start, end, fmt.Errorf("--from invalid: %w", err)
+	}
+	settled := now.Add(-delay)
+	end = settled
+	if to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			return start, end, fmt.Errorf("--to invalid: %w", err)
+		}
+		if end.After(settled) {
+			end = settled
+		}
+	}
+	start, end = start.UTC().Truncate(step), end.UTC().Truncate(step)
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("empty range %s - %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	return start, end, nil
+}
+
+// checkStep checks that every dataset can be queried in windows of step:
+// at most its max window and, for hourly and daily datasets, whole buckets.
+func checkStep(datasets []*Dataset, step time.Duration) error {
+	if step < time.Minute {
+		return fmt.Errorf("--step must be at least 1m")
+	}
+	for _, ds := range datasets {
+		if step > ds.MaxWindow {
+			return fmt.Errorf("--step %s exceeds the max window %s of dataset %q", step, ds.MaxWindow, ds.Name)
+		}
+		if bucket := ds.bucket(); bucket > 0 && step%bucket != 0 {
+			return fmt.Errorf("--step %s is not a multiple of a bucket (%s) of %s dataset %q", step, bucket, ds.Window, ds.Name)
+		}
+	}
+	return nil
+}
+
+// backfillDatasets selects the datasets to backfill by name, defaulting to
+// the hour-bucketed ones.
+func backfillDatasets(all []*Dataset, names []string) ([]*Dataset, error) {
+	var selected []*Dataset
+	if len(names) == 0 {
+		for _, ds := range all {
+			if ds.Window == windowHourly {
+				selected = append(selected, ds)
+			}
+		}
+		return selected, nil
+	}
+	for _, name := range names {
+		found := false
+		for _, ds := range all {
+			if ds.Name == name {
+				selected = append(selected, ds)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown dataset %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// backfiller accumulates windows like the live collector and records the
+// emitted series after every step.
+type backfiller struct {
+	collector *CloudflareCollector
+	datasets  []*Dataset
+	families  map[string]*dto.MetricFamily
+}
+
+func (b *backfiller) run(t target, start, end time.Time, step time.Duration) error {
+	zs := newZoneState()
+	for since := start; since.Before(end); since = since.Add(step) {
+		until := since.Add(step)
+		for _, ds := range b.datasets {
+			if ds.Scope != t.scope {
+				continue
+			}
+			groups, err := t.client.FetchDataset(ds, t.id, since, until)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", ds.Name, since.Format(time.RFC3339), err)
+			}
+			accumulate(zs, ds, since, until, groups)
+		}
+		if err := b.record(t, zs, until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record gathers the current state of one zone or account and appends it
+// to the output families with the window end as timestamp.
+func (b *backfiller) record(t target, zs *zoneState, at time.Time) error {
+	registry := prometheus.NewRegistry()
+	snapshot := uncheckedCollector(func(ch chan<- prometheus.Metric) {
+		for _, ds := range b.datasets {
+			if ds.Scope == t.scope {
+				b.collector.emitDataset(ch, t, zs, ds)
+			}
+		}
+	})
+	if err := registry.Register(snapshot); err != nil {
+		return err
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	ts := at.UnixMilli()
+	for _, mf := range mfs {
+		family, ok := b.families[mf.GetName()]
+		if !ok {
+			family = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			b.families[mf.GetName()] = family
+		}
+		for _, m := range mf.Metric {
+			m.TimestampMs = &ts
+			family.Metric = append(family.Metric, m)
+		}
+	}
+	return nil
+}
+
+// write encodes all families as OpenMetrics, with every series' samples
+// contiguous and in time order.
+func (b *backfiller) write(w io.Writer) error {
+	names := make([]string, 0, len(b.families))
+	for name := range b.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := b.families[name]
+		sort.SliceStable(family.Metric, func(i, j int) bool {
+			li, lj := labelsString(family.Metric[i]), labelsString(family.Metric[j])
+			if li != lj {
+				return li < lj
+			}
+			return family.Metric[i].GetTimestampMs() < family.Metric[j].GetTimestampMs()
+		})
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, family); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+func labelsString(m *dto.Metric) string {
+	var s string
+	for _, l := range m.Label {
+		s += l.GetName() + "=" + l.GetValue() + "\x00"
+	}
+	return s
+}
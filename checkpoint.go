@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// checkpoint is the accumulated state of all zones and accounts, written on
+// shutdown and restored on start so counters continue across restarts.
+type checkpoint struct {
+	SavedAt time.Time                    `json:"saved_at"`
+	Labels  map[string][]string          `json:"labels"`  // label names by metric
+	Targets map[string]*targetCheckpoint `json:"targets"` // scope + "/" + ID
+}
+
+type targetCheckpoint struct {
+	LastScrape time.Time                             `json:"last_scrape"`
+	Counters   map[string]map[string]float64         `json:"counters"`
+	Histograms map[string]map[string]*histogramValue `json:"histograms"`
+	WindowEnd  map[string]time.Time                  `json:"window_end"`
+	LastProbe  time.Time                             `json:"last_probe,omitzero"` // of /probe states
+}
+
+// saveState writes the collector state to path atomically.
+func (c *CloudflareCollector) saveState(path string) error {
+	data, err := c.marshalState()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// marshalState returns the collector state as a JSON checkpoint. Each zone
+// state is copied under its lock and marshaled after releasing it, so
+// collection isn't held up by the encoding.
+func (c *CloudflareCollector) marshalState() ([]byte, error) {
+	cp := checkpoint{
+		SavedAt: time.Now().UTC(),
+		Labels:  make(map[string][]string),
+		Targets: make(map[string]*targetCheckpoint),
+	}
+	for _, ds := range c.datasets {
+		for _, m := range ds.Metrics {
+			cp.Labels[m.Name] = m.Labels
+		}
+	}
+	c.zonesMu.Lock()
+	zones := maps.Clone(c.zones)
+	lastProbe := make(map[string]time.Time, len(zones))
+	for key, zs := range zones {
+		lastProbe[key] = zs.lastProbe
+	}
+	c.zonesMu.Unlock()
+	for key, zs := range zones {
+		zs.mu.Lock()
+		t := &targetCheckpoint{
+			LastProbe:  lastProbe[key],
+			LastScrape: zs.lastScrape,
+			Counters:   make(map[string]map[string]float64, len(zs.counters)),
+			Histograms: make(map[string]map[string]*histogramValue, len(zs.histograms)),
+			WindowEnd:  maps.Clone(zs.windowEnd),
+		}
+		for name, series := range zs.counters {
+			t.Counters[name] = maps.Clone(series)
+		}
+		for name, series := range zs.histograms {
+			copied := make(map[string]*histogramValue, len(series))
+			for k, h := range series {
+				copied[k] = &histogramValue{Count: h.Count, Sum: h.Sum, Buckets: slices.Clone(h.Buckets)}
+			}
+			t.Histograms[name] = copied
+		}
+		zs.mu.Unlock()
+		cp.Targets[key] = t
+	}
+	return json.Marshal(cp)
+}
+
+// loadState restores a checkpoint written by saveState. A missing file is
+// not an error. Series of metrics that no longer exist or whose labels
+// changed, and histograms whose buckets changed, are dropped.
+func (c *CloudflareCollector) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.restoreState(data); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// restoreState replaces the state of the zones and accounts in a JSON
+// checkpoint. Targets no longer configured and expired probe states are
+// dropped, so they aren't saved again.
+func (c *CloudflareCollector) restoreState(data []byte) error {
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+
+	metrics := c.metrics()
+	// Checkpoints without label names only reveal how many there were
+	fits := func(m *DatasetMetric, key string) bool {
+		if names, ok := cp.Labels[m.Name]; ok {
+			return slices.Equal(names, m.Labels)
+		}
+		return keyFits(key, m.Labels)
+	}
+	now := time.Now()
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	for key, t := range cp.Targets {
+		if !c.restorable(key, t.LastProbe, now) {
+			continue
+		}
+		zs := newZoneState()
+		zs.lastProbe = t.LastProbe
+		for name, series := range t.Counters {
+			m, ok := metrics[name]
+			if !ok || m.Type == metricHistogram {
+				continue
+			}
+			for k := range series {
+				if !fits(m, k) {
+					delete(series, k)
+				}
+			}
+			zs.counters[name] = series
+		}
+		for name, series := range t.Histograms {
+			m, ok := metrics[name]
+			if !ok || m.Type != metricHistogram {
+				continue
+			}
+			for k, h := range series {
+				if h == nil || len(h.Buckets) != len(m.Buckets) || !fits(m, k) {
+					delete(series, k)
+				}
+			}
+			zs.histograms[name] = series
+		}
+		// Windows are resumed however old, the collector catches up in
+		// chunks and skips what is older than CATCH_UP_MAX_AGE
+		zs.lastScrape = t.LastScrape
+		for name, end := range t.WindowEnd {
+			zs.windowEnd[name] = end
+		}
+		c.zones[key] = zs
+	}
+	return nil
+}
+
+// restorable reports whether the state saved under key is of a configured
+// zone or account, or of a probe of a configured module not expired at now.
+func (c *CloudflareCollector) restorable(key string, lastProbe, now time.Time) bool {
+	if strings.HasPrefix(key, "probe/") {
+		return c.probes(key) && (lastProbe.IsZero() || now.Sub(lastProbe) <= probeStateTTL)
+	}
+	scope, id, _ := strings.Cut(key, "/")
+	_, ok := c.lookupTarget(scope, id)
+	return ok
+}
+
+// stateFamilies gathers the accumulated dataset series of all targets
+// without querying Cloudflare, e.g. to seed push baselines after a restore.
+func (c *CloudflareCollector) stateFamilies() ([]*dto.MetricFamily, error) {
+	registry := prometheus.NewRegistry()
+	state := uncheckedCollector(func(ch chan<- prometheus.Metric) {
+		for _, t := range c.targets {
+			zs := c.getZoneState(t.scope, t.id)
+			zs.mu.Lock()
+			for _, ds := range c.datasets {
+				if ds.Scope == t.scope {
+					c.emitDataset(ch, t, zs, ds)
+				}
+			}
+			zs.mu.Unlock()
+		}
+	})
+	if err := registry.Register(state); err != nil {
+		return nil, err
+	}
+	return registry.Gather()
+}
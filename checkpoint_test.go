@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCollector returns a collector for one zone, "z1", without a request
+// budget.
+func testCollector(t *testing.T, datasets ...*Dataset) *CloudflareCollector {
+	t.Helper()
+	for _, ds := range datasets {
+		testDataset(t, ds)
+	}
+	return NewCloudflareCollector(&Config{
+		Datasets:    datasets,
+		Credentials: []*Credential{{Name: "default", Zones: []string{"z1"}}},
+	})
+}
+
+func checkpointDataset(labels ...string) *Dataset {
+	ds := &Dataset{
+		Name: "requests",
+		Node: "httpRequestsAdaptiveGroups",
+		Labels: []DatasetLabel{
+			{Name: "status", Field: "dimensions.edgeResponseStatus"},
+			{Name: "country", Field: "dimensions.clientCountryName"},
+		},
+		Metrics: []DatasetMetric{
+			{Name: "requests_total", Field: "count", Labels: labels},
+			{Name: "latency", Type: metricHistogram, Field: "count", Avg: "quantiles.p50", Labels: labels,
+				Quantiles: map[float64]string{0.5: "quantiles.p50"}, Buckets: []float64{100, 1000}},
+		},
+	}
+	return ds
+}
+
+func checkpointWindow() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"count": 3.0, "quantiles": map[string]interface{}{"p50": 50.0},
+			"dimensions": map[string]interface{}{"edgeResponseStatus": 200.0, "clientCountryName": "DE"}},
+		{"count": 1.0, "quantiles": map[string]interface{}{"p50": 500.0},
+			"dimensions": map[string]interface{}{"edgeResponseStatus": 404.0, "clientCountryName": "US"}},
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	c := testCollector(t, checkpointDataset("status"))
+	zs := c.getZoneState(scopeZone, "z1")
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	accumulate(zs, c.datasets[0], since, since.Add(time.Minute), checkpointWindow())
+	zs.lastScrape = since.Add(time.Minute)
+
+	data, err := c.marshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := testCollector(t, checkpointDataset("status"))
+	if err := restored.restoreState(data); err != nil {
+		t.Fatal(err)
+	}
+	got := restored.getZoneState(scopeZone, "z1")
+	if !reflect.DeepEqual(got.counters, zs.counters) {
+		t.Errorf("counters = %v, want %v", got.counters, zs.counters)
+	}
+	if !reflect.DeepEqual(got.histograms, zs.histograms) {
+		t.Errorf("histograms = %v, want %v", got.histograms, zs.histograms)
+	}
+	if !got.lastScrape.Equal(zs.lastScrape) || !got.windowEnd["requests"].Equal(zs.windowEnd["requests"]) {
+		t.Errorf("times = %v, %v, want %v, %v", got.lastScrape, got.windowEnd, zs.lastScrape, zs.windowEnd)
+	}
+}
+
+func TestRestoreStateChangedLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		old, new   []string
+		wantSeries int
+	}{
+		{"unchanged", []string{"status"}, []string{"status"}, 2},
+		{"renamed", []string{"status"}, []string{"country"}, 0},
+		{"added", []string{"status"}, []string{"status", "country"}, 0},
+		{"removed", []string{"status", "country"}, nil, 0},
+		{"none to one", nil, []string{"status"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := testCollector(t, checkpointDataset(tt.old...))
+			since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+			accumulate(old.getZoneState(scopeZone, "z1"), old.datasets[0], since, since.Add(time.Minute), checkpointWindow())
+			data, err := old.marshalState()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := testCollector(t, checkpointDataset(tt.new...))
+			if err := c.restoreState(data); err != nil {
+				t.Fatal(err)
+			}
+			// Emitting series with the wrong number of labels panics
+			families, err := c.stateFamilies()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mf := range families {
+				if n := len(mf.GetMetric()); n != tt.wantSeries {
+					t.Errorf("%s: %d series, want %d", mf.GetName(), n, tt.wantSeries)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreStateTargets(t *testing.T) {
+	old := testCollector(t, checkpointDataset("status"))
+	now := time.Now()
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for key, lastProbe := range map[string]time.Time{
+		"zone/z1":              {},
+		"zone/removed":         {},
+		"account/removed":      {},
+		"probe/default/recent": now.Add(-time.Minute),
+		"probe/default/old":    {}, // saved before probe times were
+		"probe/default/stale":  now.Add(-probeStateTTL - time.Minute),
+		"probe/removed/p1":     now.Add(-time.Minute),
+	} {
+		zs := newZoneState()
+		zs.lastProbe = lastProbe
+		accumulate(zs, old.datasets[0], since, since.Add(time.Minute), checkpointWindow())
+		old.zones[key] = zs
+	}
+	data, err := old.marshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testCollector(t, checkpointDataset("status"))
+	c.cfg.Modules = map[string][]*Dataset{"default": c.datasets}
+	if err := c.restoreState(data); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"probe/default/old", "probe/default/recent", "zone/z1"}
+	if got := sortedKeys(c.zones); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	if got := c.zones["probe/default/recent"].lastProbe; !got.Equal(now.Add(-time.Minute)) {
+		t.Errorf("last probe %v, want the saved one", got)
+	}
+}
+
+func TestKeyFits(t *testing.T) {
+	tests := []struct {
+		key    string
+		labels []string
+		want   bool
+	}{
+		{"", nil, true},
+		{"200", nil, false},
+		{"200", []string{"status"}, true},
+		{"", []string{"status"}, true}, // one empty value
+		{counterKey("200", "DE"), []string{"status"}, false},
+		{counterKey("200", "DE"), []string{"status", "country"}, true},
+		{counterKey("", ""), []string{"status", "country"}, true},
+	}
+	for _, tt := range tests {
+		if got := keyFits(tt.key, tt.labels); got != tt.want {
+			t.Errorf("keyFits(%q, %v) = %v, want %v", tt.key, tt.labels, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -10,313 +13,369 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// counterKey builds a unique key for counter storage from metric name and label values.
+// counterKey builds a unique key for counter storage from label values.
 func counterKey(parts ...string) string {
 	return strings.Join(parts, "\x00")
 }
 
-// zoneState holds accumulated counter values and scrape timestamps per zone.
+// keyFits reports whether a series key holds one value per label name.
+func keyFits(key string, labels []string) bool {
+	if len(labels) == 0 {
+		return key == ""
+	}
+	return strings.Count(key, "\x00") == len(labels)-1
+}
+
+// uncheckedCollector collects the metrics emitted by a function. It
+// describes no metrics, which makes the registry treat it as unchecked:
+// which metrics are emitted depends on the configured datasets and isn't
+// known upfront, so they can't be checked against descriptors.
+type uncheckedCollector func(ch chan<- prometheus.Metric)
+
+func (f uncheckedCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (f uncheckedCollector) Collect(ch chan<- prometheus.Metric) { f(ch) }
+
+// zoneState holds accumulated metric values and scrape timestamps per zone
+// (or account).
 type zoneState struct {
 	mu         sync.Mutex
-	lastScrape time.Time // last adaptive query boundary
-	lastHour   time.Time // last processed 1h boundary
-	counters   map[string]float64
+	lastScrape time.Time                             // last collection, start of the next Ray ID sample window
+	counters   map[string]map[string]float64         // metric name -> counterKey(label values) -> value
+	histograms map[string]map[string]*histogramValue // metric name -> counterKey(label values) -> value
+	exemplars  map[string]prometheus.Exemplar        // status -> newest sampled Ray ID
+	windowEnd  map[string]time.Time                  // dataset name -> end of the last accumulated window, start of the next
+	windows    map[string]*window                    // dataset name -> raw values of the last accumulated window
+	lastProbe  time.Time                             // last /probe of this state, guarded by the collector's zonesMu
+
+	// Optional datasets and Ray ID samples not available to the zone or
+	// account, e.g. on its plan, skipped until the next reload
+	unavailable map[string]bool
+}
+
+// window holds the raw per-window values of one dataset, before they are
+// added to the counters: metric name -> counterKey(label values) -> value.
+// Histograms record the window's observation count.
+type window struct {
+	Since, Until time.Time
+	Values       map[string]map[string]float64
+}
+
+// histogramValue holds accumulated histogram observations. Bucket counts are
+// estimates and therefore fractional until emitted.
+type histogramValue struct {
+	Count   float64
+	Sum     float64
+	Buckets []float64 // cumulative, aligned with DatasetMetric.Buckets
 }
 
 func newZoneState() *zoneState {
 	return &zoneState{
-		counters: make(map[string]float64),
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogramValue),
+		exemplars:  make(map[string]prometheus.Exemplar),
+		windowEnd:  make(map[string]time.Time),
+		windows:    make(map[string]*window),
+
+		unavailable: make(map[string]bool),
 	}
 }
 
-func (zs *zoneState) add(key string, delta float64) float64 {
-	zs.counters[key] += delta
-	return zs.counters[key]
+func (zs *zoneState) series(metric string) map[string]float64 {
+	s, ok := zs.counters[metric]
+	if !ok {
+		s = make(map[string]float64)
+		zs.counters[metric] = s
+	}
+	return s
 }
 
-// cacheHitStatuses are cacheStatus values that count as "cached".
-var cacheHitStatuses = map[string]bool{
-	"hit":          true,
-	"stale":        true,
-	"revalidated":  true,
-	"updating":     true,
+func (zs *zoneState) add(metric, key string, delta float64) float64 {
+	s := zs.series(metric)
+	s[key] += delta
+	return s[key]
 }
 
-type CloudflareCollector struct {
-	cfg    *Config
+func (zs *zoneState) set(metric, key string, value float64) {
+	zs.series(metric)[key] = value
+}
+
+func (zs *zoneState) observe(metric, key string, count, sum float64, buckets []float64) {
+	s, ok := zs.histograms[metric]
+	if !ok {
+		s = make(map[string]*histogramValue)
+		zs.histograms[metric] = s
+	}
+	h, ok := s[key]
+	if !ok {
+		h = &histogramValue{Buckets: make([]float64, len(buckets))}
+		s[key] = h
+	}
+	h.Count += count
+	h.Sum += sum
+	for i, b := range buckets {
+		h.Buckets[i] += b
+	}
+}
+
+// exemplarLabel is the label of counters with exemplars that holds the edge
+// response status Ray IDs are sampled by.
+const exemplarLabel = "status"
+
+// raySamplesName is the skip key for the Ray ID sample query.
+const raySamplesName = "ray_samples"
+
+// target is a zone or account and the credential it is collected with.
+type target struct {
+	scope  string
+	id     string
+	cred   *Credential
 	client *GraphQLClient
+}
 
-	zones   map[string]*zoneState
+type CloudflareCollector struct {
+	cfg      *Config
+	datasets []*Dataset
+	targets  []target                  // zones and accounts of all credentials
+	clients  map[string]*GraphQLClient // by credential name
+
+	zones   map[string]*zoneState // keyed by scope + "/" + zone or account ID
 	zonesMu sync.Mutex
 
-	// Pro+ feature skip flags (log once, then skip)
-	skipFirewall     bool
-	skipHealthChecks bool
-
-	// Counter metrics (from adaptive queries - accumulate deltas)
-	requestsTotal              *prometheus.Desc
-	requestsCached             *prometheus.Desc
-	requestsEncrypted          *prometheus.Desc
-	requestsByStatus           *prometheus.Desc
-	requestsByCountry          *prometheus.Desc
-	requestsByCacheStatus      *prometheus.Desc
-	requestsByHTTPProtocol     *prometheus.Desc
-	requestsBySSLProtocol      *prometheus.Desc
-	requestsBySecurityAction   *prometheus.Desc
-	requestsBySecuritySource   *prometheus.Desc
-	requestsByDeviceType       *prometheus.Desc
-	requestsByBrowser          *prometheus.Desc
-	requestsByOS               *prometheus.Desc
-	requestsByOriginStatus     *prometheus.Desc
-	requestBytesTotal          *prometheus.Desc
-	bandwidthTotal             *prometheus.Desc
-	bandwidthCached            *prometheus.Desc
-	bandwidthEncrypted         *prometheus.Desc
-	bandwidthByCountry         *prometheus.Desc
-	dnsQueries                 *prometheus.Desc
-	firewallEventsByAction     *prometheus.Desc
-	firewallEventsBySource     *prometheus.Desc
-	firewallEventsByCountry    *prometheus.Desc
-	healthCheckEvents          *prometheus.Desc
-
-	// Counter metrics (from 1h groups - accumulate per completed hour)
-	threatsTotal           *prometheus.Desc
-	threatsByCountry       *prometheus.Desc
-	pageviewsTotal         *prometheus.Desc
-	requestsByContentType  *prometheus.Desc
-	bandwidthByContentType *prometheus.Desc
-	pageviewsByBrowser     *prometheus.Desc
+	// Optional raw window dump (--dump)
+	dump *dumper
+
+	// Zone names for log context, looked up once per zone
+	zoneNames map[string]string
+	namesMu   sync.Mutex
+
+	// Dataset metrics, keyed by metric name
+	descs map[string]*prometheus.Desc
 
 	// Gauge metrics (point-in-time)
-	uniqueVisitors *prometheus.Desc
-	zoneUp         *prometheus.Desc
-	scrapeDuration *prometheus.Desc
-}
-
-func NewCloudflareCollector(cfg *Config, client *GraphQLClient) *CloudflareCollector {
-	return &CloudflareCollector{
-		cfg:    cfg,
-		client: client,
-		zones:  make(map[string]*zoneState),
-
-		// Counter metrics - adaptive
-		requestsTotal: prometheus.NewDesc(
-			"cloudflare_zone_requests_total",
-			"Total number of HTTP requests",
-			[]string{"zone"}, nil,
-		),
-		requestsCached: prometheus.NewDesc(
-			"cloudflare_zone_requests_cached",
-			"Number of cached HTTP requests",
-			[]string{"zone"}, nil,
-		),
-		requestsEncrypted: prometheus.NewDesc(
-			"cloudflare_zone_requests_encrypted",
-			"Number of SSL/TLS encrypted HTTP requests",
-			[]string{"zone"}, nil,
-		),
-		requestsByStatus: prometheus.NewDesc(
-			"cloudflare_zone_requests_status",
-			"Number of requests by HTTP response status code",
-			[]string{"zone", "status"}, nil,
-		),
-		requestsByCountry: prometheus.NewDesc(
-			"cloudflare_zone_requests_country",
-			"Number of requests by client country",
-			[]string{"zone", "country"}, nil,
-		),
-		requestsByCacheStatus: prometheus.NewDesc(
-			"cloudflare_zone_requests_cache_status",
-			"Number of requests by cache status (hit, miss, dynamic, etc.)",
-			[]string{"zone", "cache_status"}, nil,
-		),
-		requestsByHTTPProtocol: prometheus.NewDesc(
-			"cloudflare_zone_requests_http_protocol",
-			"Number of requests by HTTP protocol version",
-			[]string{"zone", "protocol"}, nil,
-		),
-		requestsBySSLProtocol: prometheus.NewDesc(
-			"cloudflare_zone_requests_ssl_protocol",
-			"Number of requests by SSL/TLS protocol version",
-			[]string{"zone", "ssl_protocol"}, nil,
-		),
-		requestsBySecurityAction: prometheus.NewDesc(
-			"cloudflare_zone_requests_security_action",
-			"Number of requests by security action (block, managed_challenge, etc.)",
-			[]string{"zone", "action"}, nil,
-		),
-		requestsBySecuritySource: prometheus.NewDesc(
-			"cloudflare_zone_requests_security_source",
-			"Number of requests by security source (botFight, waf, firewall, etc.)",
-			[]string{"zone", "source"}, nil,
-		),
-		requestsByDeviceType: prometheus.NewDesc(
-			"cloudflare_zone_requests_device_type",
-			"Number of requests by client device type (desktop, mobile, etc.)",
-			[]string{"zone", "device_type"}, nil,
-		),
-		requestsByBrowser: prometheus.NewDesc(
-			"cloudflare_zone_requests_browser",
-			"Number of requests by browser family",
-			[]string{"zone", "browser"}, nil,
+	zoneUp           *prometheus.Desc
+	accountUp        *prometheus.Desc
+	zoneWindowEnd    *prometheus.Desc
+	accountWindowEnd *prometheus.Desc
+	zoneBacklog      *prometheus.Desc
+	accountBacklog   *prometheus.Desc
+	scrapeDuration   *prometheus.Desc
+
+	// Sharding metrics
+	shardInfo    *prometheus.Desc
+	shardTargets *prometheus.Desc
+
+	// Credential metrics, labeled with the credential name
+	credentialLoaded *prometheus.Desc
+	authFailures     *prometheus.Desc
+	budgetUsed       *prometheus.Desc
+	budgetDeferred   *prometheus.Desc
+}
+
+func NewCloudflareCollector(cfg *Config) *CloudflareCollector {
+	c := &CloudflareCollector{
+		cfg:       cfg,
+		datasets:  cfg.Datasets,
+		zones:     make(map[string]*zoneState),
+		descs:     make(map[string]*prometheus.Desc),
+		zoneNames: make(map[string]string),
+		clients:   make(map[string]*GraphQLClient),
+
+		zoneUp: prometheus.NewDesc(
+			"cloudflare_zone_up",
+			"Whether the zone scrape was successful (1=up, 0=down)",
+			targetLabels(cfg, "zone"), nil,
 		),
-		requestsByOS: prometheus.NewDesc(
-			"cloudflare_zone_requests_os",
-			"Number of requests by client operating system",
-			[]string{"zone", "os"}, nil,
+		accountUp: prometheus.NewDesc(
+			"cloudflare_account_up",
+			"Whether the account scrape was successful (1=up, 0=down)",
+			targetLabels(cfg, "account_id"), nil,
 		),
-		requestsByOriginStatus: prometheus.NewDesc(
-			"cloudflare_zone_requests_origin_status",
-			"Number of requests by origin server response status code",
-			[]string{"zone", "status"}, nil,
+		zoneWindowEnd: prometheus.NewDesc(
+			"cloudflare_zone_data_window_end_seconds",
+			"End of the last data window accumulated per dataset (Unix time)",
+			targetLabels(cfg, "zone", "dataset"), nil,
 		),
-		requestBytesTotal: prometheus.NewDesc(
-			"cloudflare_zone_request_bytes_total",
-			"Total inbound request bytes (client to edge)",
-			[]string{"zone"}, nil,
+		accountWindowEnd: prometheus.NewDesc(
+			"cloudflare_account_data_window_end_seconds",
+			"End of the last data window accumulated per dataset (Unix time)",
+			targetLabels(cfg, "account_id", "dataset"), nil,
 		),
-		bandwidthTotal: prometheus.NewDesc(
-			"cloudflare_zone_bandwidth_total_bytes",
-			"Total bandwidth in bytes",
-			[]string{"zone"}, nil,
+		zoneBacklog: prometheus.NewDesc(
+			"cloudflare_zone_catch_up_backlog_seconds",
+			"Time of data per dataset left to catch up on later scrapes",
+			targetLabels(cfg, "zone", "dataset"), nil,
 		),
-		bandwidthCached: prometheus.NewDesc(
-			"cloudflare_zone_bandwidth_cached_bytes",
-			"Cached bandwidth in bytes",
-			[]string{"zone"}, nil,
+		accountBacklog: prometheus.NewDesc(
+			"cloudflare_account_catch_up_backlog_seconds",
+			"Time of data per dataset left to catch up on later scrapes",
+			targetLabels(cfg, "account_id", "dataset"), nil,
 		),
-		bandwidthEncrypted: prometheus.NewDesc(
-			"cloudflare_zone_bandwidth_encrypted_bytes",
-			"SSL/TLS encrypted bandwidth in bytes",
-			[]string{"zone"}, nil,
+		scrapeDuration: prometheus.NewDesc(
+			"cloudflare_scrape_duration_seconds",
+			"Duration of the last scrape in seconds",
+			nil, nil,
 		),
-		bandwidthByCountry: prometheus.NewDesc(
-			"cloudflare_zone_bandwidth_country_bytes",
-			"Bandwidth by client country in bytes",
-			[]string{"zone", "country"}, nil,
+		shardInfo: prometheus.NewDesc(
+			"cloudflare_exporter_shard_info",
+			"Shard of this instance, always 1",
+			[]string{"shard_index", "shard_count"}, nil,
 		),
-		dnsQueries: prometheus.NewDesc(
-			"cloudflare_zone_dns_queries",
-			"Number of DNS queries",
-			[]string{"zone", "query_name", "query_type", "response_code"}, nil,
+		shardTargets: prometheus.NewDesc(
+			"cloudflare_exporter_shard_targets",
+			"Number of zones or accounts collected by this shard",
+			[]string{"scope"}, nil,
 		),
-		firewallEventsByAction: prometheus.NewDesc(
-			"cloudflare_zone_firewall_events_action",
-			"Number of firewall events by action (block, challenge, etc.)",
-			[]string{"zone", "action"}, nil,
+		credentialLoaded: prometheus.NewDesc(
+			"cloudflare_exporter_credential_last_reload_timestamp_seconds",
+			"Time the credential's secrets were last loaded (Unix time)",
+			[]string{"account"}, nil,
 		),
-		firewallEventsBySource: prometheus.NewDesc(
-			"cloudflare_zone_firewall_events_source",
-			"Number of firewall events by source (waf, firewallRules, rateLimit, etc.)",
-			[]string{"zone", "source"}, nil,
+		authFailures: prometheus.NewDesc(
+			"cloudflare_exporter_auth_failures_total",
+			"API requests rejected as unauthenticated",
+			[]string{"account"}, nil,
 		),
-		firewallEventsByCountry: prometheus.NewDesc(
-			"cloudflare_zone_firewall_events_country",
-			"Number of firewall events by client country",
-			[]string{"zone", "country"}, nil,
+		budgetUsed: prometheus.NewDesc(
+			"cloudflare_exporter_api_budget_utilization",
+			"Share of the GraphQL request budget currently used (0-1)",
+			[]string{"account"}, nil,
 		),
-		healthCheckEvents: prometheus.NewDesc(
-			"cloudflare_zone_health_check_events",
-			"Number of health check events",
-			[]string{"zone", "status", "origin_ip", "health_check_name", "region"}, nil,
+		budgetDeferred: prometheus.NewDesc(
+			"cloudflare_exporter_api_requests_deferred_total",
+			"GraphQL queries deferred because the request budget was exhausted",
+			[]string{"account", "priority"}, nil,
 		),
+	}
 
-		// Counter metrics - 1h groups
-		threatsTotal: prometheus.NewDesc(
-			"cloudflare_zone_threats_total",
-			"Total number of threats",
-			[]string{"zone"}, nil,
-		),
-		threatsByCountry: prometheus.NewDesc(
-			"cloudflare_zone_threats_country",
-			"Number of threats by client country",
-			[]string{"zone", "country"}, nil,
-		),
-		pageviewsTotal: prometheus.NewDesc(
-			"cloudflare_zone_pageviews_total",
-			"Total number of page views",
-			[]string{"zone"}, nil,
-		),
-		requestsByContentType: prometheus.NewDesc(
-			"cloudflare_zone_requests_content_type",
-			"Number of requests by response content type",
-			[]string{"zone", "content_type"}, nil,
-		),
-		bandwidthByContentType: prometheus.NewDesc(
-			"cloudflare_zone_bandwidth_content_type_bytes",
-			"Bandwidth by response content type in bytes",
-			[]string{"zone", "content_type"}, nil,
-		),
-		pageviewsByBrowser: prometheus.NewDesc(
-			"cloudflare_zone_pageviews_browser",
-			"Page views by browser family",
-			[]string{"zone", "browser"}, nil,
-		),
+	for _, ds := range c.datasets {
+		for _, m := range ds.Metrics {
+			c.descs[m.Name] = prometheus.NewDesc(
+				m.Name, m.Help,
+				targetLabels(cfg, ds.scopeLabel(), m.Labels...), nil,
+			)
+		}
+	}
 
-		// Gauge metrics
-		uniqueVisitors: prometheus.NewDesc(
-			"cloudflare_zone_unique_visitors",
-			"Number of unique visitors (last completed hour)",
-			[]string{"zone"}, nil,
-		),
-		zoneUp: prometheus.NewDesc(
-			"cloudflare_zone_up",
-			"Whether the zone scrape was successful (1=up, 0=down)",
-			[]string{"zone"}, nil,
-		),
-		scrapeDuration: prometheus.NewDesc(
-			"cloudflare_scrape_duration_seconds",
-			"Duration of the last scrape in seconds",
-			nil, nil,
-		),
+	for _, cred := range cfg.Credentials {
+		client := NewGraphQLClient(cred, newScheduler(cfg.APIBudget, time.Duration(cfg.APIBudgetMaxWait)*time.Second))
+		c.clients[cred.Name] = client
+		for _, id := range cred.Zones {
+			if cfg.owns(id) {
+				c.targets = append(c.targets, target{scope: scopeZone, id: id, cred: cred, client: client})
+			}
+		}
+		for _, id := range cred.Accounts {
+			if cfg.owns(id) {
+				c.targets = append(c.targets, target{scope: scopeAccount, id: id, cred: cred, client: client})
+			}
+		}
+	}
+	return c
+}
+
+// metrics returns the metrics of all datasets by name.
+func (c *CloudflareCollector) metrics() map[string]*DatasetMetric {
+	metrics := make(map[string]*DatasetMetric)
+	for _, ds := range c.datasets {
+		for i := range ds.Metrics {
+			metrics[ds.Metrics[i].Name] = &ds.Metrics[i]
+		}
 	}
+	return metrics
 }
 
-func (c *CloudflareCollector) getZoneState(zoneID string) *zoneState {
+// targetLabels returns the label names of a zone or account series: the
+// scope label, "account" with named credentials, then extra labels.
+func targetLabels(cfg *Config, scopeLabel string, extra ...string) []string {
+	labels := []string{scopeLabel}
+	if cfg.AccountLabel {
+		labels = append(labels, "account")
+	}
+	return append(labels, extra...)
+}
+
+// labelValues returns the values for targetLabels, followed by extra values.
+func (c *CloudflareCollector) labelValues(t target, extra ...string) []string {
+	values := []string{t.id}
+	if c.cfg.AccountLabel {
+		values = append(values, t.cred.Name)
+	}
+	return append(values, extra...)
+}
+
+func (c *CloudflareCollector) getZoneState(scope, id string) *zoneState {
 	c.zonesMu.Lock()
 	defer c.zonesMu.Unlock()
-	zs, ok := c.zones[zoneID]
+	key := scope + "/" + id
+	zs, ok := c.zones[key]
 	if !ok {
 		zs = newZoneState()
-		c.zones[zoneID] = zs
+		c.zones[key] = zs
 	}
 	return zs
 }
 
+// logger returns a logger carrying the zone ID and name, or the account ID,
+// and the credential name.
+func (c *CloudflareCollector) logger(t target) *slog.Logger {
+	logger := slog.Default()
+	if c.cfg.AccountLabel {
+		logger = logger.With("account", t.cred.Name)
+	}
+	if t.scope == scopeAccount {
+		return logger.With("account_id", t.id)
+	}
+	if name := c.zoneName(t); name != "" {
+		return logger.With("zone", t.id, "zone_name", name)
+	}
+	return logger.With("zone", t.id)
+}
+
+// zoneName looks up a zone's name once; failed lookups are not retried.
+func (c *CloudflareCollector) zoneName(t target) string {
+	c.namesMu.Lock()
+	name, ok := c.zoneNames[t.id]
+	c.namesMu.Unlock()
+	if ok {
+		return name
+	}
+	name, err := t.client.ZoneName(t.id)
+	if err != nil {
+		slog.Debug("zone name lookup failed", append([]any{"zone", t.id}, errAttrs(err)...)...)
+	}
+	c.namesMu.Lock()
+	c.zoneNames[t.id] = name
+	c.namesMu.Unlock()
+	return name
+}
+
+func (c *CloudflareCollector) hasScope(scope string) bool {
+	for _, ds := range c.datasets {
+		if ds.Scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *CloudflareCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.requestsTotal
-	ch <- c.requestsCached
-	ch <- c.requestsEncrypted
-	ch <- c.requestsByStatus
-	ch <- c.requestsByCountry
-	ch <- c.requestsByCacheStatus
-	ch <- c.requestsByHTTPProtocol
-	ch <- c.requestsBySSLProtocol
-	ch <- c.requestsBySecurityAction
-	ch <- c.requestsBySecuritySource
-	ch <- c.requestsByDeviceType
-	ch <- c.requestsByBrowser
-	ch <- c.requestsByOS
-	ch <- c.requestsByOriginStatus
-	ch <- c.requestBytesTotal
-	ch <- c.bandwidthTotal
-	ch <- c.bandwidthCached
-	ch <- c.bandwidthEncrypted
-	ch <- c.bandwidthByCountry
-	ch <- c.dnsQueries
-	ch <- c.firewallEventsByAction
-	ch <- c.firewallEventsBySource
-	ch <- c.firewallEventsByCountry
-	ch <- c.healthCheckEvents
-	ch <- c.threatsTotal
-	ch <- c.threatsByCountry
-	ch <- c.pageviewsTotal
-	ch <- c.requestsByContentType
-	ch <- c.bandwidthByContentType
-	ch <- c.pageviewsByBrowser
-	ch <- c.uniqueVisitors
+	for _, desc := range c.descs {
+		ch <- desc
+	}
 	ch <- c.zoneUp
+	ch <- c.accountUp
+	ch <- c.zoneWindowEnd
+	ch <- c.accountWindowEnd
+	ch <- c.zoneBacklog
+	ch <- c.accountBacklog
 	ch <- c.scrapeDuration
+	ch <- c.shardInfo
+	ch <- c.shardTargets
+	ch <- c.credentialLoaded
+	ch <- c.authFailures
+	ch <- c.budgetUsed
+	ch <- c.budgetDeferred
 }
 
 func (c *CloudflareCollector) Collect(ch chan<- prometheus.Metric) {
@@ -324,487 +383,489 @@ func (c *CloudflareCollector) Collect(ch chan<- prometheus.Metric) {
 	now := time.Now().UTC()
 
 	var wg sync.WaitGroup
-	for _, zone := range c.cfg.Zones {
+	for _, t := range c.targets {
+		if !c.hasScope(t.scope) {
+			continue
+		}
 		wg.Add(1)
-		go func(zoneID string) {
+		go func() {
 			defer wg.Done()
-			c.collectZone(ch, zoneID, now)
-		}(zone)
+			c.collectTarget(ch, c.getZoneState(t.scope, t.id), t, c.datasets, now)
+		}()
 	}
 	wg.Wait()
 
 	ch <- prometheus.MustNewConstMetric(c.scrapeDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+	c.collectSelf(ch)
 }
 
-func (c *CloudflareCollector) collectZone(ch chan<- prometheus.Metric, zoneID string, now time.Time) {
-	zs := c.getZoneState(zoneID)
-	zs.mu.Lock()
+// collectSelf emits the exporter's own metrics, which don't query
+// Cloudflare.
+func (c *CloudflareCollector) collectSelf(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.shardInfo, prometheus.GaugeValue, 1,
+		strconv.Itoa(c.cfg.ShardIndex), strconv.Itoa(c.cfg.ShardCount))
+	owned := map[string]int{scopeZone: 0, scopeAccount: 0}
+	for _, t := range c.targets {
+		owned[t.scope]++
+	}
+	for scope, n := range owned {
+		ch <- prometheus.MustNewConstMetric(c.shardTargets, prometheus.GaugeValue, float64(n), scope)
+	}
+	for _, cred := range c.cfg.Credentials {
+		ch <- prometheus.MustNewConstMetric(c.credentialLoaded, prometheus.GaugeValue,
+			float64(cred.loadedAt.Load())/1e9, cred.Name)
+		ch <- prometheus.MustNewConstMetric(c.authFailures, prometheus.CounterValue,
+			float64(cred.authFailures.Load()), cred.Name)
+		if s := c.clients[cred.Name].sched; s != nil {
+			ch <- prometheus.MustNewConstMetric(c.budgetUsed, prometheus.GaugeValue, s.utilization(), cred.Name)
+			for p := range s.deferred {
+				ch <- prometheus.MustNewConstMetric(c.budgetDeferred, prometheus.CounterValue,
+					float64(s.deferred[p].Load()), cred.Name, priorityNames[p])
+			}
+		}
+	}
+}
+
+// fetchResult is the outcome of one dataset's window within a scrape,
+// fetched in chunks.
+type fetchResult struct {
+	fetched bool
+	since   time.Time // window due
+	until   time.Time
+	chunks  []chunk       // fetched, oldest first
+	failed  chunk         // the chunk that failed with err
+	backlog time.Duration // left to fetch on later collections
+	err     error
+}
 
-	// Determine adaptive time window
-	adaptiveSince := zs.lastScrape
-	if adaptiveSince.IsZero() {
-		adaptiveSince = now.Add(-time.Duration(c.cfg.ScrapeDelay) * time.Second)
+// chunk is one query of a window.
+type chunk struct {
+	since, until time.Time
+	duration     time.Duration
+	groups       []map[string]interface{}
+}
+
+// nextWindow returns the window of a dataset following the last one, which
+// ended at end (zero if there was none), and whether it is due at now.
+// Adaptive windows are due once the dataset's interval has passed, hourly
+// and daily ones once an hour or day has completed and delay has passed
+// since, so Cloudflare has ingested it before it's counted once and for all.
+func (ds *Dataset) nextWindow(end, now time.Time, delay time.Duration) (since, until time.Time, due bool) {
+	if bucket := ds.bucket(); bucket > 0 {
+		until = now.Add(-delay).Truncate(bucket)
+		if since = end; since.IsZero() {
+			since = until.Add(-bucket)
+		}
+		return since, until, until.After(since)
+	}
+	if since = end; since.IsZero() {
+		since = now.Add(-delay)
 	}
+	return since, now, now.Sub(since) >= ds.Interval
+}
 
-	// Determine 1h time window
-	currentHour := now.Truncate(time.Hour)
-	hourSince := zs.lastHour
-	if hourSince.IsZero() {
-		hourSince = currentHour.Add(-time.Hour)
+// fetchChunks fetches the window due in chunks of at most the dataset's
+// max window, oldest first, and stops at the first error or after
+// CATCH_UP_MAX_CHUNKS chunks. The rest is the backlog for later collections.
+func (c *CloudflareCollector) fetchChunks(r *fetchResult, t target, ds *Dataset) {
+	for since := r.since; since.Before(r.until); {
+		if len(r.chunks) == c.cfg.CatchUpMaxChunks {
+			r.backlog = r.until.Sub(since)
+			return
+		}
+		until := since.Add(ds.MaxWindow)
+		if until.After(r.until) {
+			until = r.until
+		}
+		start := time.Now()
+		groups, err := t.client.FetchDataset(ds, t.id, since, until)
+		k := chunk{since: since, until: until, duration: time.Since(start), groups: groups}
+		if err != nil {
+			r.failed, r.err = k, err
+			r.backlog = r.until.Sub(since)
+			return
+		}
+		r.chunks = append(r.chunks, k)
+		since = until
 	}
-	needHourlyFetch := currentHour.After(hourSince)
+}
 
+// collectTarget fetches the given datasets of a scope for one zone or
+// account, accumulates the new window into zs and emits the result. Each
+// dataset continues from the end of its own last window, so a failed or
+// deferred window is fetched again on the next collection, and a window
+// longer than the dataset's max window is caught up in chunks.
+func (c *CloudflareCollector) collectTarget(ch chan<- prometheus.Metric, zs *zoneState, t target, all []*Dataset, now time.Time) {
+	scope, id := t.scope, t.id
+	logger := c.logger(t)
+	delay := time.Duration(c.cfg.ScrapeDelay) * time.Second
+	oldest := now.Add(-time.Duration(c.cfg.CatchUpMaxAge) * time.Second)
+
+	// Determine the windows due, skipping gaps too old to catch up
+	zs.mu.Lock()
+	var datasets []*Dataset
+	for _, ds := range all {
+		if ds.Scope == scope && !zs.unavailable[ds.Name] {
+			datasets = append(datasets, ds)
+		}
+	}
+	fetchSamples := c.cfg.Exemplars && hasExemplars(datasets) && !zs.unavailable[raySamplesName]
+	results := make([]fetchResult, len(datasets))
+	samplesSince := zs.lastScrape
+	if samplesSince.IsZero() || samplesSince.Before(now.Add(-delay)) {
+		samplesSince = now.Add(-delay)
+	}
+	for i, ds := range datasets {
+		r := &results[i]
+		r.since, r.until, r.fetched = ds.nextWindow(zs.windowEnd[ds.Name], now, delay)
+		resume := oldest
+		if bucket := ds.bucket(); bucket > 0 {
+			resume = oldest.Truncate(bucket)
+		}
+		if r.since.Before(resume) {
+			logger.Warn("data gap exceeds catch-up limit, skipping", "dataset", ds.Name, windowAttr(r.since, resume))
+			r.since = resume
+		}
+	}
 	zs.mu.Unlock()
 
 	// Fetch all data in parallel (no lock held during HTTP calls)
-	var (
-		adaptiveGroups []HTTPRequestAdaptiveGroup
-		securityGroups []HTTPSecurityAdaptiveGroup
-		statusGroups   []HTTPStatusGroup
-		countryGroups  []HTTPCountryGroup
-		http1hGroups   []HTTPRequests1hGroup
-		dnsGroups      []DNSAnalyticsGroup
-		fwGroups       []FirewallEventGroup
-		hcGroups       []HealthCheckGroup
-
-		adaptiveErr, securityErr, statusErr, countryErr error
-		http1hErr, dnsErr, fwErr, hcErr                 error
-	)
-
 	var wg sync.WaitGroup
-	wg.Add(5) // adaptive, security, status, country, dns are always fetched
-
-	go func() {
-		defer wg.Done()
-		adaptiveGroups, adaptiveErr = c.client.FetchHTTPRequestsAdaptive(zoneID, adaptiveSince, now)
-	}()
-	go func() {
-		defer wg.Done()
-		securityGroups, securityErr = c.client.FetchHTTPSecurityAdaptive(zoneID, adaptiveSince, now)
-	}()
-	go func() {
-		defer wg.Done()
-		statusGroups, statusErr = c.client.FetchHTTPRequestsByStatus(zoneID, adaptiveSince, now)
-	}()
-	go func() {
-		defer wg.Done()
-		countryGroups, countryErr = c.client.FetchHTTPRequestsByCountry(zoneID, adaptiveSince, now)
-	}()
-	go func() {
-		defer wg.Done()
-		dnsGroups, dnsErr = c.client.FetchDNSAnalytics(zoneID, adaptiveSince, now)
-	}()
-
-	if needHourlyFetch {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			http1hGroups, http1hErr = c.client.FetchHTTPRequests1h(zoneID, hourSince, currentHour)
-		}()
-	}
-
-	if !c.skipFirewall {
+	for i, ds := range datasets {
+		if !results[i].fetched {
+			continue
+		}
 		wg.Add(1)
-		go func() {
+		go func(r *fetchResult, ds *Dataset) {
 			defer wg.Done()
-			fwGroups, fwErr = c.client.FetchFirewallEvents(zoneID, adaptiveSince, now)
-		}()
+			c.fetchChunks(r, t, ds)
+		}(&results[i], ds)
 	}
 
-	if !c.skipHealthChecks {
+	// Sample Ray IDs of error responses for exemplars
+	var (
+		samples    map[int]RaySample
+		samplesErr error
+	)
+	if fetchSamples {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			hcGroups, hcErr = c.client.FetchHealthChecks(zoneID, adaptiveSince, now)
+			samples, samplesErr = t.client.FetchRaySamples(id, samplesSince, now)
 		}()
 	}
-
 	wg.Wait()
 
 	// Check primary query health
-	if adaptiveErr != nil {
-		ch <- prometheus.MustNewConstMetric(c.zoneUp, prometheus.GaugeValue, 0, zoneID)
-		log.Printf("zone %s: primary adaptive query failed: %v", zoneID, adaptiveErr)
-		return
+	up, windowEnd, backlog := c.zoneUp, c.zoneWindowEnd, c.zoneBacklog
+	if scope == scopeAccount {
+		up, windowEnd, backlog = c.accountUp, c.accountWindowEnd, c.accountBacklog
+	}
+	for i, ds := range datasets {
+		// A deferred primary query is retried on the next scrape like any other
+		if r := results[i]; ds.Primary && r.err != nil && !errors.Is(r.err, errBudgetExhausted) {
+			ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0, c.labelValues(t)...)
+			logger.Error("primary query failed", append([]any{"dataset", ds.Name, windowAttr(r.failed.since, r.failed.until),
+				"duration", r.failed.duration}, errAttrs(r.err)...)...)
+			return
+		}
 	}
-	ch <- prometheus.MustNewConstMetric(c.zoneUp, prometheus.GaugeValue, 1, zoneID)
+	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1, c.labelValues(t)...)
 
 	// Acquire lock, accumulate deltas, emit metrics
 	zs.mu.Lock()
 	defer zs.mu.Unlock()
 
-	// --- Adaptive: cache, protocol, SSL + bytes ---
-	c.processAdaptiveCounters(ch, zoneID, zs, adaptiveGroups)
-
-	// --- Adaptive: security, device, browser, OS, origin ---
-	if securityErr != nil {
-		log.Printf("zone %s: security adaptive query failed: %v", zoneID, securityErr)
-	} else {
-		c.processSecurityCounters(ch, zoneID, zs, securityGroups)
-	}
-
-	// --- Adaptive: by status ---
-	if statusErr != nil {
-		log.Printf("zone %s: status query failed: %v", zoneID, statusErr)
-	} else {
-		c.processStatusCounters(ch, zoneID, zs, statusGroups)
-	}
-
-	// --- Adaptive: by country ---
-	if countryErr != nil {
-		log.Printf("zone %s: country query failed: %v", zoneID, countryErr)
-	} else {
-		c.processCountryCounters(ch, zoneID, zs, countryGroups)
-	}
-
-	// --- DNS ---
-	if dnsErr != nil {
-		log.Printf("zone %s: dns query failed: %v", zoneID, dnsErr)
-	} else {
-		c.processDNSCounters(ch, zoneID, zs, dnsGroups)
-	}
-
-	// --- Firewall (Pro+) ---
-	if fwErr != nil {
-		log.Printf("zone %s: firewall query not available (Pro+ required), disabling", zoneID)
-		c.skipFirewall = true
-	} else if !c.skipFirewall {
-		c.processFirewallCounters(ch, zoneID, zs, fwGroups)
-	}
-
-	// --- Health checks (Pro+) ---
-	if hcErr != nil {
-		log.Printf("zone %s: health check query not available (Pro+ required), disabling", zoneID)
-		c.skipHealthChecks = true
-	} else if !c.skipHealthChecks {
-		c.processHealthCheckCounters(ch, zoneID, zs, hcGroups)
-	}
-
-	// --- 1h groups (hourly counters + unique visitors gauge) ---
-	if needHourlyFetch {
-		if http1hErr != nil {
-			log.Printf("zone %s: 1h query failed: %v", zoneID, http1hErr)
+	if fetchSamples {
+		if errors.Is(samplesErr, errBudgetExhausted) {
+			logger.Debug("ray sample query deferred", errAttrs(samplesErr)...)
+		} else if isUnavailable(samplesErr) {
+			logger.Warn("ray sample query not available, skipping exemplars until reload", errAttrs(samplesErr)...)
+			zs.unavailable[raySamplesName] = true
+		} else if samplesErr != nil {
+			logger.Warn("ray sample query failed", errAttrs(samplesErr)...)
 		} else {
-			c.processHourlyCounters(ch, zoneID, zs, http1hGroups)
-			zs.lastHour = currentHour
+			zs.setExemplars(samples)
 		}
-	} else {
-		// Emit current counter values even when no new hourly data
-		c.emitHourlyCounters(ch, zoneID, zs)
 	}
 
-	zs.lastScrape = now
-}
-
-func (c *CloudflareCollector) processAdaptiveCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HTTPRequestAdaptiveGroup) {
-	// Aggregate deltas from this scrape window
-	var totalCount, cachedCount, encryptedCount float64
-	var totalBW, cachedBW, encryptedBW float64
-	var totalRequestBytes float64
-	cacheMap := make(map[string]float64)
-	protocolMap := make(map[string]float64)
-	sslMap := make(map[string]float64)
-
-	for _, g := range groups {
-		count := float64(g.Count)
-		bw := float64(g.Sum.EdgeResponseBytes)
-		reqBytes := float64(g.Sum.EdgeRequestBytes)
-		totalCount += count
-		totalBW += bw
-		totalRequestBytes += reqBytes
-
-		cs := g.Dimensions.CacheStatus
-		if cs != "" {
-			cacheMap[cs] += count
-			if cacheHitStatuses[cs] {
-				cachedCount += count
-				cachedBW += bw
+	for i, ds := range datasets {
+		r := results[i]
+		dsLogger := logger.With("dataset", ds.Name)
+		for _, k := range r.chunks {
+			if c.dump != nil {
+				rec := dumpRecord{Scope: scope, ID: id, Dataset: ds.Name, Since: k.since, Until: k.until, FetchedAt: now, Groups: k.groups}
+				if err := c.dump.write(rec); err != nil {
+					dsLogger.Error("dump failed", errAttrs(err)...)
+				}
 			}
+			dsLogger.Debug("window fetched", windowAttr(k.since, k.until), "duration", k.duration, "groups", len(k.groups))
+			accumulate(zs, ds, k.since, k.until, k.groups)
 		}
-
-		p := g.Dimensions.ClientRequestHTTPProtocol
-		if p != "" {
-			protocolMap[p] += count
-		}
-
-		s := g.Dimensions.ClientSSLProtocol
-		if s != "" {
-			sslMap[s] += count
-			if s != "none" {
-				encryptedCount += count
-				encryptedBW += bw
+		if r.err != nil {
+			errLogger := dsLogger.With(windowAttr(r.failed.since, r.failed.until), "duration", r.failed.duration)
+			switch {
+			case errors.Is(r.err, errBudgetExhausted):
+				// Not a failure of the dataset, retried on the next scrape
+				errLogger.Info("query deferred", errAttrs(r.err)...)
+			case ds.Optional && isUnavailable(r.err):
+				errLogger.Warn("query not available, skipping until reload", errAttrs(r.err)...)
+				zs.unavailable[ds.Name] = true
+				continue
+			default:
+				errLogger.Error("query failed", errAttrs(r.err)...)
 			}
+		} else if r.backlog > 0 {
+			dsLogger.Info("catching up", "chunks", len(r.chunks), "backlog", r.backlog)
 		}
+		// Emit current values even when no new data was fetched
+		c.emitDataset(ch, t, zs, ds)
+		if end, ok := zs.windowEnd[ds.Name]; ok {
+			ch <- prometheus.MustNewConstMetric(windowEnd, prometheus.GaugeValue,
+				float64(end.Unix()), c.labelValues(t, ds.Name)...)
+		}
+		ch <- prometheus.MustNewConstMetric(backlog, prometheus.GaugeValue,
+			r.backlog.Seconds(), c.labelValues(t, ds.Name)...)
 	}
 
-	// Accumulate and emit scalar counters
-	ch <- prometheus.MustNewConstMetric(c.requestsTotal, prometheus.CounterValue,
-		zs.add(counterKey("requests_total"), totalCount), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.requestsCached, prometheus.CounterValue,
-		zs.add(counterKey("requests_cached"), cachedCount), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.requestsEncrypted, prometheus.CounterValue,
-		zs.add(counterKey("requests_encrypted"), encryptedCount), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.bandwidthTotal, prometheus.CounterValue,
-		zs.add(counterKey("bandwidth_total"), totalBW), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.bandwidthCached, prometheus.CounterValue,
-		zs.add(counterKey("bandwidth_cached"), cachedBW), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.bandwidthEncrypted, prometheus.CounterValue,
-		zs.add(counterKey("bandwidth_encrypted"), encryptedBW), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.requestBytesTotal, prometheus.CounterValue,
-		zs.add(counterKey("request_bytes"), totalRequestBytes), zoneID)
+	zs.lastScrape = now
+}
 
-	// Accumulate and emit labeled counters
-	for cs, count := range cacheMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByCacheStatus, prometheus.CounterValue,
-			zs.add(counterKey("cache_status", cs), count), zoneID, cs)
-	}
-	for p, count := range protocolMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByHTTPProtocol, prometheus.CounterValue,
-			zs.add(counterKey("http_protocol", p), count), zoneID, p)
-	}
-	for s, count := range sslMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsBySSLProtocol, prometheus.CounterValue,
-			zs.add(counterKey("ssl_protocol", s), count), zoneID, s)
+// hasExemplars reports whether a metric of the datasets carries exemplars,
+// which are only sampled for them.
+func hasExemplars(datasets []*Dataset) bool {
+	for _, ds := range datasets {
+		for _, m := range ds.Metrics {
+			if m.Exemplars {
+				return true
+			}
+		}
 	}
+	return false
 }
 
-func (c *CloudflareCollector) processSecurityCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HTTPSecurityAdaptiveGroup) {
-	secActionMap := make(map[string]float64)
-	secSourceMap := make(map[string]float64)
-	deviceMap := make(map[string]float64)
-	browserMap := make(map[string]float64)
-	osMap := make(map[string]float64)
-	originStatusMap := make(map[string]float64)
-
-	for _, g := range groups {
-		count := float64(g.Count)
+// setExemplars records the newest Ray ID per status as the exemplar of the
+// counters with exemplars. Older exemplars stay until a newer sample
+// replaces them.
+func (zs *zoneState) setExemplars(samples map[int]RaySample) {
+	for status, r := range samples {
+		zs.exemplars[strconv.Itoa(status)] = prometheus.Exemplar{
+			Value:     1,
+			Labels:    prometheus.Labels{"ray_id": r.RayName},
+			Timestamp: r.Datetime,
+		}
+	}
+}
 
-		if a := g.Dimensions.SecurityAction; a != "" && a != "unknown" {
-			secActionMap[a] += count
+// accumulate folds one window of dataset groups into the state: counters add
+// the window's deltas, gauges keep the value of the newest hour or day, or
+// the last value seen, and ratios divide two window values. The raw window is
+// kept for the JSON and line protocol endpoints.
+func accumulate(zs *zoneState, ds *Dataset, since, until time.Time, groups []map[string]interface{}) {
+	if ds.bucket() > 0 {
+		groups = ds.unseenBuckets(groups, since, until, zs.windowEnd[ds.Name])
+	}
+	raw := &window{Since: since, Until: until, Values: make(map[string]map[string]float64)}
+	zs.windows[ds.Name] = raw
+	zs.windowEnd[ds.Name] = until
+
+	for i := range ds.Metrics {
+		m := &ds.Metrics[i]
+		if m.Type == metricHistogram {
+			raw.Values[m.Name] = accumulateHistogram(zs, ds, m, groups)
+			continue
 		}
-		if s := g.Dimensions.SecuritySource; s != "" && s != "unknown" {
-			secSourceMap[s] += count
+		deltas := make(map[string]float64)
+		newest := make(map[string]time.Time)
+		raw.Values[m.Name] = deltas
+		for _, g := range groups {
+			bucket, _ := ds.groupBucket(g)
+			for _, e := range m.entries(g) {
+				values, ok := ds.labelValues(m, g, e)
+				if !ok {
+					continue
+				}
+				key := counterKey(values...)
+				v := numberValue(m.fieldValue(g, e, m.Field)) * m.Scale
+				if m.Type == metricGauge && m.Per == "" {
+					if _, ok := deltas[key]; !ok || !bucket.Before(newest[key]) {
+						deltas[key], newest[key] = v, bucket
+					}
+				} else {
+					deltas[key] += v
+				}
+			}
 		}
-		if d := g.Dimensions.ClientDeviceType; d != "" {
-			deviceMap[d] += count
+
+		if m.Per != "" {
+			// Set below, once the window of the metric divided by is complete
+			continue
 		}
-		if b := g.Dimensions.UserAgentBrowser; b != "" {
-			browserMap[b] += count
+		if m.Type == metricGauge {
+			for key, v := range deltas {
+				zs.set(m.Name, key, v)
+			}
+			continue
 		}
-		if o := g.Dimensions.UserAgentOS; o != "" {
-			osMap[o] += count
+		if len(m.Labels) == 0 {
+			// Unlabeled counters exist from the first window on, even at zero
+			zs.add(m.Name, counterKey(), deltas[counterKey()])
+			continue
 		}
-		if status := g.Dimensions.OriginResponseStatus; status > 0 {
-			key := fmt.Sprintf("%d", status)
-			originStatusMap[key] += count
+		for key, delta := range deltas {
+			if delta != 0 {
+				zs.add(m.Name, key, delta)
+			}
 		}
 	}
 
-	for action, count := range secActionMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsBySecurityAction, prometheus.CounterValue,
-			zs.add(counterKey("sec_action", action), count), zoneID, action)
-	}
-	for source, count := range secSourceMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsBySecuritySource, prometheus.CounterValue,
-			zs.add(counterKey("sec_source", source), count), zoneID, source)
-	}
-	for device, count := range deviceMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByDeviceType, prometheus.CounterValue,
-			zs.add(counterKey("device_type", device), count), zoneID, device)
-	}
-	for browser, count := range browserMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByBrowser, prometheus.CounterValue,
-			zs.add(counterKey("browser", browser), count), zoneID, browser)
-	}
-	for os, count := range osMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByOS, prometheus.CounterValue,
-			zs.add(counterKey("os", os), count), zoneID, os)
-	}
-	for status, count := range originStatusMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByOriginStatus, prometheus.CounterValue,
-			zs.add(counterKey("origin_status", status), count), zoneID, status)
-	}
-}
-
-func (c *CloudflareCollector) processStatusCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HTTPStatusGroup) {
-	statusMap := make(map[string]float64)
-	for _, g := range groups {
-		if g.Dimensions.EdgeResponseStatus > 0 {
-			key := fmt.Sprintf("%d", g.Dimensions.EdgeResponseStatus)
-			statusMap[key] += float64(g.Count)
+	// Ratios keep their last value through windows without data. Label
+	// values missing from a window with data are dropped, so ratios of
+	// label values that no longer occur don't linger.
+	for i := range ds.Metrics {
+		m := &ds.Metrics[i]
+		if m.Per == "" {
+			continue
 		}
-	}
-	for status, count := range statusMap {
-		ch <- prometheus.MustNewConstMetric(c.requestsByStatus, prometheus.CounterValue,
-			zs.add(counterKey("status", status), count), zoneID, status)
+		ratios := make(map[string]float64)
+		for key, total := range raw.Values[m.Per] {
+			if total > 0 {
+				ratios[key] = raw.Values[m.Name][key] / total
+				zs.set(m.Name, key, ratios[key])
+			}
+		}
+		if len(ratios) > 0 {
+			for key := range zs.counters[m.Name] {
+				if _, ok := ratios[key]; !ok {
+					delete(zs.counters[m.Name], key)
+				}
+			}
+		}
+		raw.Values[m.Name] = ratios
 	}
 }
 
-func (c *CloudflareCollector) processCountryCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HTTPCountryGroup) {
+// unseenBuckets keeps the groups of the buckets in [since, until) after end,
+// the end of the buckets already counted, so an hour or day fetched again (an
+// overlapping page or window) isn't counted twice. Groups without bucket are
+// kept.
+func (ds *Dataset) unseenBuckets(groups []map[string]interface{}, since, until, end time.Time) []map[string]interface{} {
+	if end.After(since) {
+		since = end
+	}
+	kept := make([]map[string]interface{}, 0, len(groups))
 	for _, g := range groups {
-		if country := g.Dimensions.ClientCountryName; country != "" {
-			count := float64(g.Count)
-			bw := float64(g.Sum.EdgeResponseBytes)
-			ch <- prometheus.MustNewConstMetric(c.requestsByCountry, prometheus.CounterValue,
-				zs.add(counterKey("country", country), count), zoneID, country)
-			ch <- prometheus.MustNewConstMetric(c.bandwidthByCountry, prometheus.CounterValue,
-				zs.add(counterKey("bw_country", country), bw), zoneID, country)
+		if bucket, ok := ds.groupBucket(g); ok && (bucket.Before(since) || !bucket.Before(until)) {
+			continue
 		}
+		kept = append(kept, g)
 	}
+	return kept
 }
 
-func (c *CloudflareCollector) processDNSCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []DNSAnalyticsGroup) {
+// accumulateHistogram adds each group's observations to a histogram metric,
+// spreading the group's count over the buckets according to its quantiles.
+// It returns the window's observation count per series.
+func accumulateHistogram(zs *zoneState, ds *Dataset, m *DatasetMetric, groups []map[string]interface{}) map[string]float64 {
+	counts := make(map[string]float64)
 	for _, g := range groups {
-		key := counterKey("dns", g.Dimensions.QueryName, g.Dimensions.QueryType, g.Dimensions.ResponseCode)
-		ch <- prometheus.MustNewConstMetric(c.dnsQueries, prometheus.CounterValue,
-			zs.add(key, float64(g.Count)),
-			zoneID, g.Dimensions.QueryName, g.Dimensions.QueryType, g.Dimensions.ResponseCode)
+		for _, e := range m.entries(g) {
+			values, ok := ds.labelValues(m, g, e)
+			if !ok {
+				continue
+			}
+			count := numberValue(m.fieldValue(g, e, m.Field))
+			if count <= 0 {
+				continue
+			}
+			quantiles := make(map[float64]float64, len(m.Quantiles))
+			for q, field := range m.Quantiles {
+				quantiles[q] = numberValue(m.fieldValue(g, e, field)) * m.Scale
+			}
+			var sum float64
+			if m.Avg != "" {
+				sum = numberValue(m.fieldValue(g, e, m.Avg)) * m.Scale * count
+			}
+			key := counterKey(values...)
+			counts[key] += count
+			zs.observe(m.Name, key, count, sum, m.bucketCounts(count, quantiles))
+		}
 	}
+	return counts
 }
 
-func (c *CloudflareCollector) processFirewallCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []FirewallEventGroup) {
-	actionMap := make(map[string]float64)
-	sourceMap := make(map[string]float64)
-	countryMap := make(map[string]float64)
-
-	for _, g := range groups {
-		count := float64(g.Count)
-		if a := g.Dimensions.Action; a != "" {
-			actionMap[a] += count
+// emitDataset emits the accumulated values of every metric of a dataset.
+// Hour-bucketed datasets carry the end of their data window as sample
+// timestamp when DATA_TIMESTAMPS is enabled.
+func (c *CloudflareCollector) emitDataset(ch chan<- prometheus.Metric, t target, zs *zoneState, ds *Dataset) {
+	// Daily windows end up to a day before the scrape, too old for most
+	// remote write receivers, so only hourly ones carry their window end
+	var timestamp time.Time
+	if c.cfg.DataTimestamps && ds.Window == windowHourly {
+		timestamp = zs.windowEnd[ds.Name]
+	}
+	for _, m := range ds.Metrics {
+		if m.Type == metricHistogram {
+			c.emitHistogram(ch, t, zs, &m, timestamp)
+			continue
 		}
-		if s := g.Dimensions.Source; s != "" {
-			sourceMap[s] += count
+		valueType := prometheus.CounterValue
+		if m.Type == metricGauge {
+			valueType = prometheus.GaugeValue
 		}
-		if cn := g.Dimensions.ClientCountryName; cn != "" {
-			countryMap[cn] += count
+		status := -1
+		if m.Exemplars {
+			status = slices.Index(m.Labels, exemplarLabel)
 		}
-	}
-
-	for action, count := range actionMap {
-		ch <- prometheus.MustNewConstMetric(c.firewallEventsByAction, prometheus.CounterValue,
-			zs.add(counterKey("fw_action", action), count), zoneID, action)
-	}
-	for source, count := range sourceMap {
-		ch <- prometheus.MustNewConstMetric(c.firewallEventsBySource, prometheus.CounterValue,
-			zs.add(counterKey("fw_source", source), count), zoneID, source)
-	}
-	for country, count := range countryMap {
-		ch <- prometheus.MustNewConstMetric(c.firewallEventsByCountry, prometheus.CounterValue,
-			zs.add(counterKey("fw_country", country), count), zoneID, country)
-	}
-}
-
-func (c *CloudflareCollector) processHealthCheckCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HealthCheckGroup) {
-	for _, g := range groups {
-		key := counterKey("hc", g.Dimensions.HealthStatus, g.Dimensions.OriginIP,
-			g.Dimensions.HealthCheckName, g.Dimensions.Region)
-		ch <- prometheus.MustNewConstMetric(c.healthCheckEvents, prometheus.CounterValue,
-			zs.add(key, float64(g.Count)),
-			zoneID, g.Dimensions.HealthStatus, g.Dimensions.OriginIP,
-			g.Dimensions.HealthCheckName, g.Dimensions.Region)
-	}
-}
-
-func (c *CloudflareCollector) processHourlyCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState, groups []HTTPRequests1hGroup) {
-	var threats, pageViews float64
-	var lastUniques int64
-	threatsByCountry := make(map[string]float64)
-	contentTypeReqs := make(map[string]float64)
-	contentTypeBytes := make(map[string]float64)
-	browserViews := make(map[string]float64)
-
-	for _, g := range groups {
-		threats += float64(g.Sum.Threats)
-		pageViews += float64(g.Sum.PageViews)
-		lastUniques = g.Uniq.Uniques // use latest hour's uniques
-
-		for _, entry := range g.Sum.CountryMap {
-			if entry.Threats > 0 {
-				threatsByCountry[entry.Country] += float64(entry.Threats)
+		for key, val := range zs.counters[m.Name] {
+			if !keyFits(key, m.Labels) {
+				continue // accumulated by a scrape still running with the previous configuration
 			}
-		}
-		for _, entry := range g.Sum.ContentTypeMap {
-			if entry.ContentType != "" {
-				contentTypeReqs[entry.ContentType] += float64(entry.Requests)
-				contentTypeBytes[entry.ContentType] += float64(entry.Bytes)
+			var values []string
+			if len(m.Labels) > 0 {
+				values = strings.Split(key, "\x00")
 			}
-		}
-		for _, entry := range g.Sum.BrowserMap {
-			if entry.Browser != "" {
-				browserViews[entry.Browser] += float64(entry.PageViews)
+			metric := prometheus.MustNewConstMetric(c.descs[m.Name], valueType, val, c.labelValues(t, values...)...)
+			if e, ok := zs.exemplars[valueAt(values, status)]; ok && status >= 0 {
+				if withExemplar, err := prometheus.NewMetricWithExemplars(metric, e); err == nil {
+					metric = withExemplar
+				}
 			}
+			ch <- withTimestamp(metric, timestamp)
 		}
 	}
-
-	// Accumulate and emit hourly counters
-	ch <- prometheus.MustNewConstMetric(c.threatsTotal, prometheus.CounterValue,
-		zs.add(counterKey("threats_total"), threats), zoneID)
-	ch <- prometheus.MustNewConstMetric(c.pageviewsTotal, prometheus.CounterValue,
-		zs.add(counterKey("pageviews_total"), pageViews), zoneID)
-
-	for country, t := range threatsByCountry {
-		ch <- prometheus.MustNewConstMetric(c.threatsByCountry, prometheus.CounterValue,
-			zs.add(counterKey("threats_country", country), t), zoneID, country)
-	}
-	for ct, reqs := range contentTypeReqs {
-		ch <- prometheus.MustNewConstMetric(c.requestsByContentType, prometheus.CounterValue,
-			zs.add(counterKey("ct_reqs", ct), reqs), zoneID, ct)
-	}
-	for ct, bytes := range contentTypeBytes {
-		ch <- prometheus.MustNewConstMetric(c.bandwidthByContentType, prometheus.CounterValue,
-			zs.add(counterKey("ct_bw", ct), bytes), zoneID, ct)
-	}
-	for browser, views := range browserViews {
-		ch <- prometheus.MustNewConstMetric(c.pageviewsByBrowser, prometheus.CounterValue,
-			zs.add(counterKey("pv_browser", browser), views), zoneID, browser)
-	}
-
-	// Unique visitors is a gauge (not cumulative) - store for emission between hourly updates
-	zs.counters["last_uniques"] = float64(lastUniques)
-	ch <- prometheus.MustNewConstMetric(c.uniqueVisitors, prometheus.GaugeValue, float64(lastUniques), zoneID)
 }
 
-// emitHourlyCounters emits current accumulated values for hourly counter metrics
-// when no new hourly data is available yet.
-func (c *CloudflareCollector) emitHourlyCounters(ch chan<- prometheus.Metric, zoneID string, zs *zoneState) {
-	// Emit scalar counters at their current accumulated value
-	ch <- prometheus.MustNewConstMetric(c.threatsTotal, prometheus.CounterValue,
-		zs.counters[counterKey("threats_total")], zoneID)
-	ch <- prometheus.MustNewConstMetric(c.pageviewsTotal, prometheus.CounterValue,
-		zs.counters[counterKey("pageviews_total")], zoneID)
-
-	// Emit labeled counters for all known keys
-	prefix := "threats_country\x00"
-	for key, val := range zs.counters {
-		if strings.HasPrefix(key, prefix) {
-			country := key[len(prefix):]
-			ch <- prometheus.MustNewConstMetric(c.threatsByCountry, prometheus.CounterValue, val, zoneID, country)
+func (c *CloudflareCollector) emitHistogram(ch chan<- prometheus.Metric, t target, zs *zoneState, m *DatasetMetric, timestamp time.Time) {
+	for key, h := range zs.histograms[m.Name] {
+		if !keyFits(key, m.Labels) || len(h.Buckets) != len(m.Buckets) {
+			continue // accumulated by a scrape still running with the previous configuration
 		}
-	}
-	prefix = "ct_reqs\x00"
-	for key, val := range zs.counters {
-		if strings.HasPrefix(key, prefix) {
-			ct := key[len(prefix):]
-			ch <- prometheus.MustNewConstMetric(c.requestsByContentType, prometheus.CounterValue, val, zoneID, ct)
+		labels := c.labelValues(t)
+		if len(m.Labels) > 0 {
+			labels = append(labels, strings.Split(key, "\x00")...)
 		}
-	}
-	prefix = "ct_bw\x00"
-	for key, val := range zs.counters {
-		if strings.HasPrefix(key, prefix) {
-			ct := key[len(prefix):]
-			ch <- prometheus.MustNewConstMetric(c.bandwidthByContentType, prometheus.CounterValue, val, zoneID, ct)
+		buckets := make(map[float64]uint64, len(m.Buckets))
+		for i, bound := range m.Buckets {
+			buckets[bound] = uint64(math.Round(h.Buckets[i]))
 		}
+		ch <- withTimestamp(prometheus.MustNewConstHistogram(c.descs[m.Name],
+			uint64(math.Round(h.Count)), h.Sum, buckets, labels...), timestamp)
 	}
-	prefix = "pv_browser\x00"
-	for key, val := range zs.counters {
-		if strings.HasPrefix(key, prefix) {
-			browser := key[len(prefix):]
-			ch <- prometheus.MustNewConstMetric(c.pageviewsByBrowser, prometheus.CounterValue, val, zoneID, browser)
-		}
+}
+
+// valueAt returns the label value at index i, or "" if there is none.
+func valueAt(values []string, i int) string {
+	if i < 0 || i >= len(values) {
+		return ""
 	}
+	return values[i]
+}
 
-	// Unique visitors: emit last known value (gauge)
-	if val, ok := zs.counters["last_uniques"]; ok {
-		ch <- prometheus.MustNewConstMetric(c.uniqueVisitors, prometheus.GaugeValue, val, zoneID)
+// withTimestamp attaches an explicit sample timestamp unless it is zero.
+func withTimestamp(m prometheus.Metric, t time.Time) prometheus.Metric {
+	if t.IsZero() {
+		return m
 	}
+	return prometheus.NewMetricWithTimestamp(t, m)
 }
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func testDataset(t *testing.T, ds *Dataset) *Dataset {
+	t.Helper()
+	if err := ds.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	return ds
+}
+
+func TestAccumulate(t *testing.T) {
+	ds := testDataset(t, &Dataset{
+		Name: "test",
+		Node: "httpRequestsAdaptiveGroups",
+		Labels: []DatasetLabel{
+			{Name: "cache_status", Field: "dimensions.cacheStatus", Skip: []string{""}},
+			{Name: "country", Field: "sum.countryMap.clientCountryName"},
+		},
+		Metrics: []DatasetMetric{
+			{Name: "requests", Field: "count"},
+			{Name: "cached", Field: "count", Match: map[string][]string{"cache_status": {"hit"}}},
+			{Name: "uncached", Field: "count", Exclude: map[string][]string{"cache_status": {"hit"}}},
+			{Name: "by_status", Field: "count", Labels: []string{"cache_status"}},
+			{Name: "by_country", Field: "sum.countryMap.requests", Each: "sum.countryMap", Labels: []string{"country"}},
+			{Name: "last", Type: metricGauge, Field: "count"},
+			{Name: "kib", Field: "sum.bytes", Scale: 1.0 / 1024},
+		},
+	})
+	window := []map[string]interface{}{
+		{"count": 10.0, "dimensions": map[string]interface{}{"cacheStatus": "hit"},
+			"sum": map[string]interface{}{"bytes": 2048.0, "countryMap": []interface{}{
+				map[string]interface{}{"clientCountryName": "DE", "requests": 6.0},
+				map[string]interface{}{"clientCountryName": "US", "requests": 4.0},
+			}}},
+		{"count": 5.0, "dimensions": map[string]interface{}{"cacheStatus": "miss"},
+			"sum": map[string]interface{}{"bytes": 1024.0}},
+		{"count": 1.0, "dimensions": map[string]interface{}{"cacheStatus": ""}},
+	}
+
+	zs := newZoneState()
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	accumulate(zs, ds, since, since.Add(time.Minute), window)
+	accumulate(zs, ds, since.Add(time.Minute), since.Add(2*time.Minute), window)
+
+	tests := []struct {
+		metric string
+		key    string
+		want   float64
+	}{
+		{"requests", counterKey(), 32},
+		{"cached", counterKey(), 20},
+		{"uncached", counterKey(), 12},
+		{"by_status", counterKey("hit"), 20},
+		{"by_status", counterKey("miss"), 10},
+		{"by_status", counterKey(""), 0}, // skipped
+		{"by_country", counterKey("DE"), 12},
+		{"by_country", counterKey("US"), 8},
+		{"last", counterKey(), 1},
+		{"kib", counterKey(), 6},
+	}
+	for _, tt := range tests {
+		if got := zs.counters[tt.metric][tt.key]; got != tt.want {
+			t.Errorf("%s{%q} = %v, want %v", tt.metric, tt.key, got, tt.want)
+		}
+	}
+	if end := zs.windowEnd[ds.Name]; !end.Equal(since.Add(2 * time.Minute)) {
+		t.Errorf("window end = %v", end)
+	}
+}
+
+func TestDatasetValidate(t *testing.T) {
+	metric := []DatasetMetric{{Name: "m", Field: "count"}}
+	tests := []struct {
+		name string
+		ds   Dataset
+		ok   bool
+	}{
+		{"minimal", Dataset{Name: "a", Node: "n", Metrics: metric}, true},
+		{"no name", Dataset{Node: "n", Metrics: metric}, false},
+		{"no node", Dataset{Name: "a", Metrics: metric}, false},
+		{"no metrics", Dataset{Name: "a", Node: "n"}, false},
+		{"bad scope", Dataset{Name: "a", Node: "n", Scope: "user", Metrics: metric}, false},
+		{"bad window", Dataset{Name: "a", Node: "n", Window: "weekly", Metrics: metric}, false},
+		{"bad metric name", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "a-b", Field: "count"}}}, false},
+		{"unknown label", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "m", Field: "count", Labels: []string{"x"}}}}, false},
+		{"scope label", Dataset{Name: "a", Node: "n", Labels: []DatasetLabel{{Name: "zone", Field: "dimensions.x"}}, Metrics: metric}, false},
+		{"account label", Dataset{Name: "a", Node: "n", Labels: []DatasetLabel{{Name: "account", Field: "dimensions.x"}}, Metrics: metric}, false},
+		{"dataset label", Dataset{Name: "a", Node: "n", Labels: []DatasetLabel{{Name: "dataset", Field: "dimensions.x"}}, Metrics: metric}, false},
+		{"duplicate label", Dataset{Name: "a", Node: "n", Labels: []DatasetLabel{{Name: "x", Field: "dimensions.x"}, {Name: "x", Field: "dimensions.y"}}, Metrics: metric}, false},
+		{"index in field", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "m", Field: "sum[0].x"}}}, false},
+		{"wildcard in label", Dataset{Name: "a", Node: "n", Labels: []DatasetLabel{{Name: "x", Field: "dimensions.*"}}, Metrics: metric}, false},
+		{"dotted key", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "m", Field: "sum['a.b']"}}}, false},
+		{"each wildcard", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "m", Field: "sum.map.x", Each: "sum.map[*]"}}}, true},
+		{"index with custom query", Dataset{Name: "a", Query: "q", Path: "$.rows[*]", Metrics: []DatasetMetric{{Name: "m", Field: "values[0]"}}}, true},
+		{"each mismatch", Dataset{Name: "a", Node: "n", Metrics: []DatasetMetric{{Name: "m", Field: "sum.x", Each: "sum.map"}}}, false},
+		{"interval on hourly", Dataset{Name: "a", Node: "n", Window: windowHourly, Interval: time.Minute, Metrics: metric}, false},
+		{"hourly order", Dataset{Name: "a", Node: "n", Window: windowHourly, OrderBy: "count_DESC", Metrics: metric}, false},
+		{"hourly max window", Dataset{Name: "a", Node: "n", Window: windowHourly, MaxWindow: 90 * time.Minute, Metrics: metric}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ds.validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBuiltinDatasetsValid(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, ds := range builtinDatasets() {
+		if err := ds.validate(); err != nil {
+			t.Errorf("%s: %v", ds.Name, err)
+		}
+		if seen[ds.Name] {
+			t.Errorf("duplicate dataset %s", ds.Name)
+		}
+		seen[ds.Name] = true
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	metric := []DatasetMetric{{Name: "m", Field: "count"}}
+	adaptive := testDataset(t, &Dataset{Name: "a", Node: "n", Interval: time.Minute, Metrics: metric})
+	hourly := testDataset(t, &Dataset{Name: "h", Node: "n", Window: windowHourly, Metrics: metric})
+	daily := testDataset(t, &Dataset{Name: "d", Node: "n", Window: windowDaily, Metrics: metric})
+	at := func(day, hour, minute int) time.Time { return time.Date(2026, 1, day, hour, minute, 0, 0, time.UTC) }
+	const delay = 5 * time.Minute
+	tests := []struct {
+		name         string
+		ds           *Dataset
+		end, now     time.Time
+		since, until time.Time
+		due          bool
+	}{
+		{"adaptive first", adaptive, time.Time{}, at(1, 10, 30), at(1, 10, 25), at(1, 10, 30), true},
+		{"adaptive due", adaptive, at(1, 10, 29), at(1, 10, 30), at(1, 10, 29), at(1, 10, 30), true},
+		{"adaptive within interval", adaptive, at(1, 10, 30), at(1, 10, 30).Add(30 * time.Second), at(1, 10, 30), at(1, 10, 30).Add(30 * time.Second), false},
+		{"hourly first", hourly, time.Time{}, at(1, 10, 30), at(1, 9, 0), at(1, 10, 0), true},
+		{"hourly first settling", hourly, time.Time{}, at(1, 10, 3), at(1, 8, 0), at(1, 9, 0), true},
+		{"hourly settling", hourly, at(1, 9, 0), at(1, 10, 3), at(1, 9, 0), at(1, 9, 0), false},
+		{"hourly settled", hourly, at(1, 9, 0), at(1, 10, 5), at(1, 9, 0), at(1, 10, 0), true},
+		{"hourly catching up", hourly, at(1, 2, 0), at(1, 10, 30), at(1, 2, 0), at(1, 10, 0), true},
+		{"daily settling", daily, at(1, 0, 0), at(2, 0, 3), at(1, 0, 0), at(1, 0, 0), false},
+		{"daily settled", daily, at(1, 0, 0), at(2, 0, 6), at(1, 0, 0), at(2, 0, 0), true},
+		{"daily first", daily, time.Time{}, at(2, 0, 3), time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), at(1, 0, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, until, due := tt.ds.nextWindow(tt.end, tt.now, delay)
+			if !since.Equal(tt.since) || !until.Equal(tt.until) || due != tt.due {
+				t.Errorf("nextWindow = %v, %v, %v, want %v, %v, %v", since, until, due, tt.since, tt.until, tt.due)
+			}
+		})
+	}
+}
+
+func TestUnseenBuckets(t *testing.T) {
+	ds := testDataset(t, &Dataset{Name: "h", Node: "n", Window: windowHourly, Metrics: []DatasetMetric{{Name: "m", Field: "count"}}})
+	hour := func(h int) time.Time { return time.Date(2026, 1, 1, h, 0, 0, 0, time.UTC) }
+	group := func(h int) map[string]interface{} {
+		return map[string]interface{}{"dimensions": map[string]interface{}{"datetime": hour(h).Format(time.RFC3339)}}
+	}
+	groups := []map[string]interface{}{group(8), group(9), group(10), group(11), {"count": 1.0}}
+	tests := []struct {
+		name             string
+		since, until     time.Time
+		end              time.Time
+		wantHours        []int
+		wantWithoutHours int
+	}{
+		{"window", hour(9), hour(11), time.Time{}, []int{9, 10}, 1},
+		{"already counted", hour(8), hour(12), hour(10), []int{10, 11}, 1},
+		{"end before window", hour(10), hour(12), hour(9), []int{10, 11}, 1},
+		{"nothing new", hour(8), hour(10), hour(10), nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hours []int
+			without := 0
+			for _, g := range ds.unseenBuckets(groups, tt.since, tt.until, tt.end) {
+				if b, ok := ds.groupBucket(g); ok {
+					hours = append(hours, b.Hour())
+				} else {
+					without++
+				}
+			}
+			if !reflect.DeepEqual(hours, tt.wantHours) || without != tt.wantWithoutHours {
+				t.Errorf("kept hours %v and %d groups without, want %v and %d", hours, without, tt.wantHours, tt.wantWithoutHours)
+			}
+		})
+	}
+}
+
+func TestDataTimestamps(t *testing.T) {
+	metric := func(name string) []DatasetMetric { return []DatasetMetric{{Name: name, Field: "count"}} }
+	c := testCollector(t,
+		&Dataset{Name: "a", Node: "n", Metrics: metric("adaptive_total")},
+		&Dataset{Name: "h", Node: "n", Window: windowHourly, Metrics: metric("hourly_total")},
+		&Dataset{Name: "d", Node: "n", Window: windowDaily, Metrics: metric("daily_total")},
+	)
+	c.cfg.DataTimestamps = true
+	end := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	zs := c.getZoneState(scopeZone, "z1")
+	for _, ds := range c.datasets {
+		accumulate(zs, ds, end.Add(-time.Hour), end, []map[string]interface{}{{"count": 1.0}})
+	}
+
+	families, err := c.stateFamilies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"adaptive_total": false, "hourly_total": true, "daily_total": false}
+	if len(families) != len(want) {
+		t.Fatalf("got %d families, want %d", len(families), len(want))
+	}
+	for _, mf := range families {
+		m := mf.GetMetric()[0]
+		if stamped := m.TimestampMs != nil; stamped != want[mf.GetName()] {
+			t.Errorf("%s stamped = %v, want %v", mf.GetName(), stamped, want[mf.GetName()])
+		}
+		if m.TimestampMs != nil && m.GetTimestampMs() != end.UnixMilli() {
+			t.Errorf("%s stamped %d, want the window end", mf.GetName(), m.GetTimestampMs())
+		}
+	}
+}
+
+func TestOptionalUnavailablePerTarget(t *testing.T) {
+	ds := &Dataset{Name: "opt", Node: "httpRequestsAdaptiveGroups", Optional: true,
+		Metrics: []DatasetMetric{{Name: "opt_total", Field: "count"}}}
+	c := testCollector(t, ds)
+	c.cfg.ScrapeDelay, c.cfg.CatchUpMaxAge, c.cfg.CatchUpMaxChunks = 300, 3600, 1
+	tests := []struct {
+		zone         string
+		errMsg       string
+		code         string // of the error's extensions
+		wantRequests int
+	}{
+		{"entitled", "", "", 3},
+		{"not entitled", "zone 'x' does not have access to the path", "", 1},
+		{"not entitled, coded", "zone 'x' does not have access to the path", "authz", 1},
+		{"not entitled, reworded", "access to this dataset is restricted", "authz", 1},
+		{"failing", "internal server error", "", 3},
+		{"failing, coded", "dataset is not available right now", "internal", 3},
+	}
+	requests := make(map[string]int)
+	targets := make([]target, len(tests))
+	for i, tt := range tests {
+		client := testGraphQLErrorClient(func(map[string]interface{}) (interface{}, map[string]interface{}) {
+			requests[tt.zone]++
+			switch {
+			case tt.errMsg == "":
+				return zoneData(ds.Node, []map[string]interface{}{{"count": 1.0}}), nil
+			case tt.code == "":
+				return nil, map[string]interface{}{"message": tt.errMsg}
+			}
+			return nil, map[string]interface{}{"message": tt.errMsg, "extensions": map[string]interface{}{"code": tt.code}}
+		})
+		targets[i] = target{scope: scopeZone, id: tt.zone, cred: client.cred, client: client}
+	}
+
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for range 3 {
+		now = now.Add(time.Minute)
+		for _, tg := range targets {
+			ch := make(chan prometheus.Metric)
+			go func() {
+				defer close(ch)
+				c.collectTarget(ch, c.getZoneState(tg.scope, tg.id), tg, c.datasets, now)
+			}()
+			for range ch {
+			}
+		}
+	}
+	for _, tt := range tests {
+		if requests[tt.zone] != tt.wantRequests {
+			t.Errorf("%s: %d requests, want %d", tt.zone, requests[tt.zone], tt.wantRequests)
+		}
+	}
+}
+
+func TestRatioExpiry(t *testing.T) {
+	ds := testDataset(t, &Dataset{
+		Name: "test", Node: "n",
+		Labels: []DatasetLabel{{Name: "host", Field: "dimensions.host"}, {Name: "cache_status", Field: "dimensions.cacheStatus"}},
+		Metrics: []DatasetMetric{
+			{Name: "requests", Field: "count", Labels: []string{"host"}},
+			{Name: "hits", Field: "count", Labels: []string{"host"}, Match: map[string][]string{"cache_status": {"hit"}}},
+			{Name: "hit_ratio", Type: metricGauge, Field: "count", Labels: []string{"host"},
+				Match: map[string][]string{"cache_status": {"hit"}}, Per: "requests"},
+		},
+	})
+	group := func(host, status string, count float64) map[string]interface{} {
+		return map[string]interface{}{"count": count, "dimensions": map[string]interface{}{"host": host, "cacheStatus": status}}
+	}
+	windows := []struct {
+		name   string
+		groups []map[string]interface{}
+		want   map[string]float64
+	}{
+		{"both hosts", []map[string]interface{}{group("a", "hit", 1), group("a", "miss", 1), group("b", "hit", 3), group("b", "miss", 1)},
+			map[string]float64{"a": 0.5, "b": 0.75}},
+		{"one host", []map[string]interface{}{group("a", "hit", 1), group("a", "miss", 3)},
+			map[string]float64{"a": 0.25}},
+		{"no data", nil, map[string]float64{"a": 0.25}},
+	}
+	zs := newZoneState()
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, w := range windows {
+		accumulate(zs, ds, since, since.Add(time.Minute), w.groups)
+		since = since.Add(time.Minute)
+		if got := zs.counters["hit_ratio"]; !reflect.DeepEqual(got, w.want) {
+			t.Errorf("%s: hit_ratio = %v, want %v", w.name, got, w.want)
+		}
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	statusDataset := func(exemplars bool) *Dataset {
+		return &Dataset{
+			Name: "status", Node: "httpRequestsAdaptiveGroups",
+			Labels: []DatasetLabel{{Name: "host", Field: "dimensions.host"}, {Name: "status", Field: "dimensions.edgeResponseStatus"}},
+			Metrics: []DatasetMetric{{Name: "requests_by_status_total", Field: "count",
+				Labels: []string{"host", "status"}, Exemplars: exemplars}},
+		}
+	}
+	tests := []struct {
+		name        string
+		exemplars   bool
+		wantSamples int
+		want        []string
+	}{
+		{"configured", true, 1, []string{
+			"# TYPE requests_by_status counter\n",
+			`requests_by_status_total{host="a",status="503",zone="z1"} 2.0 # {ray_id="8a1b"} 1.0 1.76726154e+09` + "\n",
+			`requests_by_status_total{host="a",status="200",zone="z1"} 5.0` + "\n",
+		}},
+		{"not configured", false, 0, []string{
+			`requests_by_status_total{host="a",status="503",zone="z1"} 2.0` + "\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(t, statusDataset(tt.exemplars))
+			c.cfg.Exemplars, c.cfg.ScrapeDelay, c.cfg.CatchUpMaxAge, c.cfg.CatchUpMaxChunks = true, 300, 3600, 1
+			samples := 0
+			client := testGraphQLClient(func(vars map[string]interface{}) (interface{}, string) {
+				if _, ok := vars["minStatus"]; ok {
+					samples++
+					return zoneData("httpRequestsAdaptive", []map[string]interface{}{
+						{"rayName": "8a1b", "edgeResponseStatus": 503.0, "datetime": now.Add(-time.Minute).Format(time.RFC3339)},
+					}), ""
+				}
+				return zoneData("httpRequestsAdaptiveGroups", []map[string]interface{}{
+					{"count": 2.0, "dimensions": map[string]interface{}{"host": "a", "edgeResponseStatus": 503.0}},
+					{"count": 5.0, "dimensions": map[string]interface{}{"host": "a", "edgeResponseStatus": 200.0}},
+				}), ""
+			})
+			tg := target{scope: scopeZone, id: "z1", cred: client.cred, client: client}
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+				c.collectTarget(ch, c.getZoneState(tg.scope, tg.id), tg, c.datasets, now)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+			rec := httptest.NewRecorder()
+			promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(rec, req)
+
+			if samples != tt.wantSamples {
+				t.Errorf("%d sample queries, want %d", samples, tt.wantSamples)
+			}
+			body := rec.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("missing %q in\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestPrimaryDeferred(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 5, 0, 0, time.UTC)
+	first := now.Add(-2 * time.Hour).Truncate(time.Hour)
+	tests := []struct {
+		name         string
+		deferred     bool // the second hour, else it fails
+		wantUp       float64
+		wantOther    float64
+		wantEnd      time.Time
+		wantBacklogs map[string]float64
+	}{
+		{"deferred", true, 1, 1, first.Add(time.Hour), map[string]float64{"hourly": 3600, "other": 0}},
+		{"failed", false, 0, 0, first, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hourly := hourlyDataset(t, 100)
+			hourly.Primary = true
+			hourly.MaxWindow = time.Hour
+			other := &Dataset{Name: "other", Node: "httpRequestsAdaptiveGroups",
+				Metrics: []DatasetMetric{{Name: "other_total", Field: "count"}}}
+			c := testCollector(t, hourly, other)
+			c.cfg.ScrapeDelay, c.cfg.CatchUpMaxAge, c.cfg.CatchUpMaxChunks = 300, 86400, 5
+			zs := c.getZoneState(scopeZone, "z1")
+			zs.windowEnd[hourly.Name] = first
+
+			otherServed := make(chan struct{})
+			var client *GraphQLClient
+			client = testGraphQLClient(func(vars map[string]interface{}) (interface{}, string) {
+				since, _ := time.Parse(time.RFC3339, vars["since"].(string))
+				until, _ := time.Parse(time.RFC3339, vars["until"].(string))
+				if until.Sub(since) != time.Hour {
+					close(otherServed)
+					return zoneData(other.Node, []map[string]interface{}{{"count": 1.0}}), ""
+				}
+				if since.Equal(first) {
+					// Exhaust the budget once the other dataset has been fetched
+					<-otherServed
+					if tt.deferred {
+						client.sched.mu.Lock()
+						client.sched.tokens, client.sched.last = 0, time.Now()
+						client.sched.mu.Unlock()
+					}
+				} else if !tt.deferred {
+					return nil, "internal server error"
+				}
+				return zoneData(hourly.Node, []map[string]interface{}{{
+					"sum":        map[string]interface{}{"requests": 1.0},
+					"dimensions": map[string]interface{}{"datetime": since.Format(time.RFC3339)},
+				}}), ""
+			})
+			client.sched = newScheduler(100, 10*time.Millisecond)
+			tg := target{scope: scopeZone, id: "z1", cred: client.cred, client: client}
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+				c.collectTarget(ch, zs, tg, c.datasets, now)
+			}))
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			backlogs := make(map[string]float64)
+			for _, mf := range families {
+				for _, m := range mf.GetMetric() {
+					switch mf.GetName() {
+					case "cloudflare_zone_up":
+						if v := m.GetGauge().GetValue(); v != tt.wantUp {
+							t.Errorf("up = %v, want %v", v, tt.wantUp)
+						}
+					case "cloudflare_zone_catch_up_backlog_seconds":
+						for _, l := range m.GetLabel() {
+							if l.GetName() == "dataset" {
+								backlogs[l.GetValue()] = m.GetGauge().GetValue()
+							}
+						}
+					}
+				}
+			}
+			if tt.wantBacklogs != nil && !reflect.DeepEqual(backlogs, tt.wantBacklogs) {
+				t.Errorf("backlogs %v, want %v", backlogs, tt.wantBacklogs)
+			}
+			if got := zs.counters["other_total"][""]; got != tt.wantOther {
+				t.Errorf("other_total = %v, want %v", got, tt.wantOther)
+			}
+			if end := zs.windowEnd[hourly.Name]; !end.Equal(tt.wantEnd) {
+				t.Errorf("hourly window end %v, want %v", end, tt.wantEnd)
+			}
+		})
+	}
+}
+
+// catchUpClient answers hourly dataset queries with one group per hour,
+// failing the chunk starting at failAt, and records the windows queried.
+func catchUpClient(ds *Dataset, failAt time.Time, windows *[][2]time.Time) *GraphQLClient {
+	return testGraphQLClient(func(vars map[string]interface{}) (interface{}, string) {
+		since, _ := time.Parse(time.RFC3339, vars["since"].(string))
+		until, _ := time.Parse(time.RFC3339, vars["until"].(string))
+		*windows = append(*windows, [2]time.Time{since, until})
+		if since.Equal(failAt) {
+			return nil, "internal server error"
+		}
+		var groups []map[string]interface{}
+		for h := since; h.Before(until); h = h.Add(time.Hour) {
+			groups = append(groups, map[string]interface{}{
+				"sum":        map[string]interface{}{"requests": 1.0},
+				"dimensions": map[string]interface{}{"datetime": h.Format(time.RFC3339)},
+			})
+		}
+		return zoneData(ds.Node, groups), ""
+	})
+}
+
+func TestFetchChunks(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+	tests := []struct {
+		name        string
+		maxWindow   time.Duration
+		maxChunks   int
+		failAt      time.Time
+		want        [][2]time.Time // chunks fetched
+		wantFailed  time.Time      // since of the failed chunk, zero if none
+		wantBacklog time.Duration
+	}{
+		{"one chunk", 6 * time.Hour, 5, time.Time{},
+			[][2]time.Time{{hour(0), hour(5)}}, time.Time{}, 0},
+		{"split by max window", 2 * time.Hour, 5, time.Time{},
+			[][2]time.Time{{hour(0), hour(2)}, {hour(2), hour(4)}, {hour(4), hour(5)}}, time.Time{}, 0},
+		{"chunk cap", 2 * time.Hour, 2, time.Time{},
+			[][2]time.Time{{hour(0), hour(2)}, {hour(2), hour(4)}}, time.Time{}, time.Hour},
+		{"partial failure", 2 * time.Hour, 5, hour(2),
+			[][2]time.Time{{hour(0), hour(2)}}, hour(2), 3 * time.Hour},
+		{"first chunk fails", 2 * time.Hour, 5, hour(0),
+			nil, hour(0), 5 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := hourlyDataset(t, 100)
+			ds.MaxWindow = tt.maxWindow
+			c := testCollector(t)
+			c.cfg.CatchUpMaxChunks = tt.maxChunks
+			var queried [][2]time.Time
+			client := catchUpClient(ds, tt.failAt, &queried)
+			tg := target{scope: scopeZone, id: "z1", cred: client.cred, client: client}
+
+			r := &fetchResult{fetched: true, since: hour(0), until: hour(5)}
+			c.fetchChunks(r, tg, ds)
+			var got [][2]time.Time
+			for _, k := range r.chunks {
+				got = append(got, [2]time.Time{k.since, k.until})
+				if len(k.groups) != int(k.until.Sub(k.since)/time.Hour) {
+					t.Errorf("chunk %v: %d groups", k.since, len(k.groups))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunks %v, want %v", got, tt.want)
+			}
+			if (r.err != nil) != !tt.wantFailed.IsZero() || !r.failed.since.Equal(tt.wantFailed) {
+				t.Errorf("failed chunk %v (%v), want %v", r.failed.since, r.err, tt.wantFailed)
+			}
+			if r.backlog != tt.wantBacklog {
+				t.Errorf("backlog %v, want %v", r.backlog, tt.wantBacklog)
+			}
+			want := len(tt.want)
+			if !tt.wantFailed.IsZero() {
+				want++
+			}
+			if len(queried) != want {
+				t.Errorf("%d queries, want %d", len(queried), want)
+			}
+		})
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 5, 0, 0, time.UTC)
+	due := now.Truncate(time.Hour) // with a 5 minute scrape delay
+	hoursAgo := func(n int) time.Time { return due.Add(-time.Duration(n) * time.Hour) }
+	tests := []struct {
+		name        string
+		end         time.Time // of the last window
+		failAt      time.Time
+		want        [][2]time.Time // windows queried
+		wantEnd     time.Time
+		wantBacklog float64
+	}{
+		{"caught up", hoursAgo(1), time.Time{},
+			[][2]time.Time{{hoursAgo(1), due}}, due, 0},
+		{"in chunks", hoursAgo(5), time.Time{},
+			[][2]time.Time{{hoursAgo(5), hoursAgo(3)}, {hoursAgo(3), hoursAgo(1)}, {hoursAgo(1), due}}, due, 0},
+		{"chunk cap", hoursAgo(7), time.Time{},
+			[][2]time.Time{{hoursAgo(7), hoursAgo(5)}, {hoursAgo(5), hoursAgo(3)}, {hoursAgo(3), hoursAgo(1)}},
+			hoursAgo(1), 3600},
+		{"gap beyond max age", hoursAgo(30), time.Time{},
+			[][2]time.Time{{hoursAgo(8), hoursAgo(6)}, {hoursAgo(6), hoursAgo(4)}, {hoursAgo(4), hoursAgo(2)}},
+			hoursAgo(2), 2 * 3600},
+		{"resumes at the failed chunk", hoursAgo(5), hoursAgo(3),
+			[][2]time.Time{{hoursAgo(5), hoursAgo(3)}, {hoursAgo(3), hoursAgo(1)}}, hoursAgo(3), 3 * 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := hourlyDataset(t, 100)
+			ds.MaxWindow = 2 * time.Hour
+			c := testCollector(t, ds)
+			c.cfg.ScrapeDelay, c.cfg.CatchUpMaxAge, c.cfg.CatchUpMaxChunks = 300, 8*3600+300, 3
+			zs := c.getZoneState(scopeZone, "z1")
+			zs.windowEnd[ds.Name] = tt.end
+			var queried [][2]time.Time
+			client := catchUpClient(ds, tt.failAt, &queried)
+			tg := target{scope: scopeZone, id: "z1", cred: client.cred, client: client}
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+				c.collectTarget(ch, zs, tg, c.datasets, now)
+			}))
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(queried, tt.want) {
+				t.Errorf("queried %v, want %v", queried, tt.want)
+			}
+			if end := zs.windowEnd[ds.Name]; !end.Equal(tt.wantEnd) {
+				t.Errorf("window end %v, want %v", end, tt.wantEnd)
+			}
+			// One request per hour accumulated
+			if got, want := zs.counters["requests"][""], tt.wantEnd.Sub(tt.want[0][0]).Hours(); got != want {
+				t.Errorf("requests = %v, want %v", got, want)
+			}
+			backlog := -1.0
+			for _, mf := range families {
+				if mf.GetName() == "cloudflare_zone_catch_up_backlog_seconds" {
+					backlog = mf.GetMetric()[0].GetGauge().GetValue()
+				}
+			}
+			if backlog != tt.wantBacklog {
+				t.Errorf("backlog gauge %v, want %v", backlog, tt.wantBacklog)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCredential names the credential set from CF_API_TOKEN or
+// CF_API_KEY/CF_API_EMAIL, bound to CF_ZONES and CF_ACCOUNTS.
+const defaultCredential = "default"
+
+// Credential is a named API token (or key and email) with the zones and
+// accounts collected with it. Each secret can be read from a file instead,
+// which is re-read periodically so rotated secrets are picked up without a
+// restart.
+type Credential struct {
+	Name         string   `yaml:"name"`
+	APIToken     string   `yaml:"api_token"`
+	APITokenFile string   `yaml:"api_token_file"`
+	APIKey       string   `yaml:"api_key"`
+	APIKeyFile   string   `yaml:"api_key_file"`
+	APIEmail     string   `yaml:"api_email"`
+	APIEmailFile string   `yaml:"api_email_file"`
+	Zones        []string `yaml:"zones"`
+	Accounts     []string `yaml:"accounts"` // account IDs for account-scoped datasets
+
+	secret       atomic.Pointer[credentialSecret] // current secrets, swapped on reload
+	loadedAt     atomic.Int64                     // Unix nanoseconds of the last (re)load
+	authFailures atomic.Uint64                    // requests rejected as unauthenticated
+}
+
+// credentialSecret is the set of secrets a request is authorized with.
+type credentialSecret struct {
+	APIToken, APIKey, APIEmail string
+}
+
+// envCredential returns the credential set from the environment, or nil if
+// no credentials are set there.
+func envCredential() (*Credential, error) {
+	cred := &Credential{
+		Name:         defaultCredential,
+		APIToken:     os.Getenv("CF_API_TOKEN"),
+		APITokenFile: os.Getenv("CF_API_TOKEN_FILE"),
+		APIKey:       os.Getenv("CF_API_KEY"),
+		APIKeyFile:   os.Getenv("CF_API_KEY_FILE"),
+		APIEmail:     os.Getenv("CF_API_EMAIL"),
+		APIEmailFile: os.Getenv("CF_API_EMAIL_FILE"),
+		Zones:        splitList(os.Getenv("CF_ZONES")),
+		Accounts:     splitList(os.Getenv("CF_ACCOUNTS")),
+	}
+	if !cred.hasToken() && !cred.hasKey() && !cred.hasEmail() {
+		if len(cred.Zones) > 0 || len(cred.Accounts) > 0 {
+			return nil, fmt.Errorf("set CF_API_TOKEN or both CF_API_KEY and CF_API_EMAIL (or their _FILE variants)")
+		}
+		return nil, nil
+	}
+	return cred, cred.validate()
+}
+
+func (c *Credential) hasToken() bool { return c.APIToken != "" || c.APITokenFile != "" }
+func (c *Credential) hasKey() bool   { return c.APIKey != "" || c.APIKeyFile != "" }
+func (c *Credential) hasEmail() bool { return c.APIEmail != "" || c.APIEmailFile != "" }
+
+// validate checks the credential and loads its secrets.
+func (c *Credential) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("credential name is required")
+	}
+	if !c.hasToken() && (!c.hasKey() || !c.hasEmail()) {
+		return fmt.Errorf("credential %q: set an API token or both API key and email", c.Name)
+	}
+	for _, pair := range [][2]string{{c.APIToken, c.APITokenFile}, {c.APIKey, c.APIKeyFile}, {c.APIEmail, c.APIEmailFile}} {
+		if pair[0] != "" && pair[1] != "" {
+			return fmt.Errorf("credential %q: set a secret or its file, not both", c.Name)
+		}
+	}
+	if _, err := c.reload(); err != nil {
+		return fmt.Errorf("credential %q: %w", c.Name, err)
+	}
+	return nil
+}
+
+// watched reports whether any secret is read from a file.
+func (c *Credential) watched() bool {
+	return c.APITokenFile != "" || c.APIKeyFile != "" || c.APIEmailFile != ""
+}
+
+// readSecret returns value, or the trimmed contents of file if set.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return secret, nil
+}
+
+// reload reads the secret files and swaps in their contents if they
+// changed. Requests in flight keep the secrets they started with.
+func (c *Credential) reload() (changed bool, err error) {
+	var s credentialSecret
+	if s.APIToken, err = readSecret(c.APIToken, c.APITokenFile); err != nil {
+		return false, err
+	}
+	if s.APIKey, err = readSecret(c.APIKey, c.APIKeyFile); err != nil {
+		return false, err
+	}
+	if s.APIEmail, err = readSecret(c.APIEmail, c.APIEmailFile); err != nil {
+		return false, err
+	}
+	if old := c.secret.Load(); old != nil && *old == s {
+		return false, nil
+	}
+	c.secret.Store(&s)
+	c.loadedAt.Store(time.Now().UnixNano())
+	return true, nil
+}
+
+// watchCredentials re-reads the secret files of the current credentials
+// every interval until ctx is done. A failed read keeps the previous secrets.
+func watchCredentials(ctx context.Context, current func() []*Credential, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, c := range current() {
+			if !c.watched() {
+				continue
+			}
+			changed, err := c.reload()
+			switch {
+			case err != nil:
+				slog.Warn("credential reload failed, keeping previous secrets", append([]any{"account", c.Name}, errAttrs(err)...)...)
+			case changed:
+				slog.Info("credential reloaded", "account", c.Name)
+			}
+		}
+	}
+}
+
+// isAuthFailure reports whether a request was rejected for its credentials.
+func isAuthFailure(err error) bool {
+	return errorClass(err) == "auth"
+}
+
+// mergeCredentials combines the environment credential with those of the
+// config file and checks that names are unique and each zone and account
+// is bound to one credential only.
+func mergeCredentials(env *Credential, file []*Credential) ([]*Credential, error) {
+	var creds []*Credential
+	if env != nil {
+		creds = append(creds, env)
+	}
+	for _, c := range file {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("set CF_API_TOKEN or both CF_API_KEY and CF_API_EMAIL, or credentials in CONFIG_FILE")
+	}
+
+	names := make(map[string]bool)
+	bound := make(map[string]string)
+	for _, c := range creds {
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate credential %q", c.Name)
+		}
+		names[c.Name] = true
+		for _, id := range append(append([]string{}, c.Zones...), c.Accounts...) {
+			if other, ok := bound[id]; ok {
+				return nil, fmt.Errorf("%s is bound to credentials %q and %q", id, other, c.Name)
+			}
+			bound[id] = c.Name
+		}
+	}
+	return creds, nil
+}
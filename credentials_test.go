@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsAuthFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&httpStatusError{StatusCode: 401}, true},
+		{&httpStatusError{StatusCode: 403}, true},
+		{&httpStatusError{StatusCode: 429}, false},
+		{fmt.Errorf("query: %w", &httpStatusError{StatusCode: 401}), true},
+		{&graphqlError{Message: "Authentication error"}, true},
+		{&graphqlError{Message: "not authorized for that account"}, true},
+		{&graphqlError{Message: "zone 'x' does not have access to the path"}, false},
+		{fmt.Errorf("http request: %w", context.DeadlineExceeded), false},
+	}
+	for _, tt := range tests {
+		if got := isAuthFailure(tt.err); got != tt.want {
+			t.Errorf("isAuthFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func writeSecret(t *testing.T, path, secret string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, file, "one")
+	cred := &Credential{Name: "default", APITokenFile: file}
+	if err := cred.validate(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := cred.loadedAt.Load()
+
+	tests := []struct {
+		name    string
+		secret  string // written to the file, "-" to remove it
+		changed bool
+		err     bool
+		want    string
+	}{
+		{"unchanged", "one", false, false, "one"},
+		{"rotated", "two", true, false, "two"},
+		{"empty", "", false, true, "two"},
+		{"missing", "-", false, true, "two"},
+		{"restored", "three", true, false, "three"},
+	}
+	for _, tt := range tests {
+		if tt.secret == "-" {
+			os.Remove(file)
+		} else {
+			writeSecret(t, file, tt.secret)
+		}
+		changed, err := cred.reload()
+		if changed != tt.changed || (err != nil) != tt.err {
+			t.Errorf("%s: reload = %v, %v, want %v, error %v", tt.name, changed, err, tt.changed, tt.err)
+		}
+		if got := cred.secret.Load().APIToken; got != tt.want {
+			t.Errorf("%s: token %q, want %q", tt.name, got, tt.want)
+		}
+		if at := cred.loadedAt.Load(); (at != loaded) != tt.changed {
+			t.Errorf("%s: load time updated = %v, want %v", tt.name, at != loaded, tt.changed)
+		}
+		loaded = cred.loadedAt.Load()
+	}
+}
+
+func TestWatchCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, file, "one")
+	watched := &Credential{Name: "file", APITokenFile: file}
+	static := &Credential{Name: "static", APIToken: "static"}
+	for _, c := range []*Credential{watched, static} {
+		if err := c.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := NewGraphQLClient(watched, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchCredentials(ctx, func() []*Credential { return []*Credential{watched, static} }, 10*time.Millisecond)
+
+	writeSecret(t, file, "two")
+	deadline := time.Now().Add(5 * time.Second)
+	for watched.secret.Load().APIToken != "two" {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated secret not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// New requests are authorized with the rotated secret
+	req, _ := http.NewRequest(http.MethodPost, graphqlEndpoint, nil)
+	client.authorize(req)
+	if got := req.Header.Get("Authorization"); got != "Bearer two" {
+		t.Errorf("Authorization = %q, want the rotated token", got)
+	}
+	if got := static.secret.Load().APIToken; got != "static" {
+		t.Errorf("static token changed to %q", got)
+	}
+}
+
+func TestHandOverCredentialLoadTime(t *testing.T) {
+	newCollector := func(token string) *CloudflareCollector {
+		cred := &Credential{Name: "default", APIToken: token, Zones: []string{"z1"}}
+		if err := cred.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return NewCloudflareCollector(&Config{Credentials: []*Credential{cred}})
+	}
+	tests := []struct {
+		name       string
+		token      string
+		keepLoaded bool
+	}{
+		{"unchanged", "one", true},
+		{"changed", "two", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := newCollector("one")
+			loaded := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+			old.cfg.Credentials[0].loadedAt.Store(loaded)
+			old.cfg.Credentials[0].authFailures.Store(3)
+
+			next := newCollector(tt.token)
+			old.handOver(next)
+			cred := next.cfg.Credentials[0]
+			if kept := cred.loadedAt.Load() == loaded; kept != tt.keepLoaded {
+				t.Errorf("load time kept = %v, want %v", kept, tt.keepLoaded)
+			}
+			if n := cred.authFailures.Load(); n != 3 {
+				t.Errorf("%d auth failures, want 3", n)
+			}
+		})
+	}
+}
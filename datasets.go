@@ -0,0 +1,931 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dataset scopes: which GraphQL viewer collection a dataset is queried from.
+const (
+	scopeZone    = "zone"
+	scopeAccount = "account"
+)
+
+// Dataset windows: which time range a dataset is queried for on each scrape.
+const (
+	windowAdaptive = "adaptive" // [end of the last window, now), every interval
+	windowHourly   = "hourly"   // completed hours since the last processed hour
+	windowDaily    = "daily"    // completed days (UTC) since the last processed day
+)
+
+// Metric types a dataset metric can be exported as.
+const (
+	metricCounter   = "counter"   // accumulate per-window deltas
+	metricGauge     = "gauge"     // keep the last value seen
+	metricHistogram = "histogram" // classic buckets estimated from quantile fields
+)
+
+// Dataset declares a GraphQL Analytics node and how its groups map to metrics.
+// The collector builds the query, accumulates and emits metrics from it
+// without any dataset-specific code.
+type Dataset struct {
+	Name      string          `yaml:"name"`
+	Node      string          `yaml:"node"`
+	Scope     string          `yaml:"scope"`
+	Window    string          `yaml:"window"`
+	Limit     int             `yaml:"limit"`
+	OrderBy   string          `yaml:"order_by"`
+	Interval  time.Duration   `yaml:"interval"`   // minimum time between adaptive windows, 0 for every scrape
+	MaxWindow time.Duration   `yaml:"max_window"` // longest window per query, longer ones are split
+	Primary   bool            `yaml:"primary"`    // failure marks the target down and skips the rest
+	Optional  bool            `yaml:"optional"`   // skipped per zone or account once not available (e.g. Pro+ datasets)
+	OptIn     bool            `yaml:"opt_in"`     // only collected when listed in enabled_datasets
+	Labels    []DatasetLabel  `yaml:"labels"`
+	Metrics   []DatasetMetric `yaml:"metrics"`
+
+	// Query replaces the generated query with a custom GraphQL query using
+	// the same variables ($zoneID or $accountID, $since, $until). Path is a
+	// JSONPath expression selecting the result rows, e.g.
+	// "$.viewer.zones[0].pageShieldReportsAdaptiveGroups[*]".
+	Query string `yaml:"query"`
+	Path  string `yaml:"path"`
+}
+
+// DatasetLabel maps a group field (e.g. "dimensions.cacheStatus") to a label.
+// Fields are JSONPath-style paths relative to the group.
+type DatasetLabel struct {
+	Name  string   `yaml:"name"`
+	Field string   `yaml:"field"`
+	Skip  []string `yaml:"skip"` // values that drop the group from metrics using this label
+}
+
+// DatasetMetric maps a group field (e.g. "count", "sum.edgeResponseBytes") to a metric.
+type DatasetMetric struct {
+	Name   string   `yaml:"name"`
+	Help   string   `yaml:"help"`
+	Type   string   `yaml:"type"`
+	Field  string   `yaml:"field"`
+	Labels []string `yaml:"labels"`
+	// Each names an array field to iterate instead of the group itself.
+	// Fields below it (e.g. "sum.countryMap.threats") resolve per entry.
+	Each string `yaml:"each"`
+	// Match and Exclude filter groups by dataset label value, whether or
+	// not the label is exported on this metric.
+	Match   map[string][]string `yaml:"match"`
+	Exclude map[string][]string `yaml:"exclude"`
+	// Scale multiplies every value read for this metric, e.g. 0.001 for ms -> s.
+	Scale float64 `yaml:"scale"`
+	// Per names another metric of the dataset with the same labels to divide
+	// by: the metric is a gauge of the ratio of both window values.
+	Per string `yaml:"per"`
+	// Exemplars attaches the newest sampled Ray ID of each series' status
+	// (EXEMPLARS) to a zone counter whose "status" label holds the edge
+	// response status.
+	Exemplars bool `yaml:"exemplars"`
+
+	// Histogram metrics: Field is the observation count, Quantiles maps
+	// quantiles (0-1) to the fields holding them and Avg optionally names
+	// the average field used for the histogram sum. Buckets are upper bounds
+	// after scaling (default: prometheus.DefBuckets).
+	Quantiles map[float64]string `yaml:"quantiles"`
+	Avg       string             `yaml:"avg"`
+	Buckets   []float64          `yaml:"buckets"`
+}
+
+// cacheHitStatuses are cacheStatus values that count as "cached".
+var cacheHitStatuses = []string{"hit", "stale", "revalidated", "updating"}
+
+// builtinDatasets are the datasets exported out of the box. Datasets from the
+// config file with the same name replace them.
+func builtinDatasets() []*Dataset {
+	return []*Dataset{
+		{
+			// httpRequests1hGroups: pre-aggregated hourly HTTP analytics (works on all plans)
+			Name:    "http_requests_1h",
+			Node:    "httpRequests1hGroups",
+			Window:  windowHourly,
+			Limit:   24,
+			OrderBy: "datetime_DESC",
+			Labels: []DatasetLabel{
+				{Name: "country", Field: "sum.countryMap.clientCountryName"},
+				{Name: "content_type", Field: "sum.contentTypeMap.edgeResponseContentTypeName", Skip: []string{""}},
+				{Name: "browser", Field: "sum.browserMap.uaBrowserFamily", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_threats_total", Help: "Total number of threats", Field: "sum.threats"},
+				{Name: "cloudflare_zone_threats_country", Help: "Number of threats by client country",
+					Field: "sum.countryMap.threats", Each: "sum.countryMap", Labels: []string{"country"}},
+				{Name: "cloudflare_zone_pageviews_total", Help: "Total number of page views", Field: "sum.pageViews"},
+				{Name: "cloudflare_zone_requests_content_type", Help: "Number of requests by response content type",
+					Field: "sum.contentTypeMap.requests", Each: "sum.contentTypeMap", Labels: []string{"content_type"}},
+				{Name: "cloudflare_zone_bandwidth_content_type_bytes", Help: "Bandwidth by response content type in bytes",
+					Field: "sum.contentTypeMap.bytes", Each: "sum.contentTypeMap", Labels: []string{"content_type"}},
+				{Name: "cloudflare_zone_pageviews_browser", Help: "Page views by browser family",
+					Field: "sum.browserMap.pageViews", Each: "sum.browserMap", Labels: []string{"browser"}},
+				{Name: "cloudflare_zone_unique_visitors", Help: "Number of unique visitors (last completed hour)",
+					Type: metricGauge, Field: "uniq.uniques"},
+			},
+		},
+		{
+			// httpRequests1dGroups: daily totals for long-term trends (works on all plans)
+			Name:    "http_requests_1d",
+			Node:    "httpRequests1dGroups",
+			Window:  windowDaily,
+			Limit:   31,
+			OrderBy: "date_DESC",
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_requests_daily_total", Help: "Total number of requests, counted per completed day",
+					Field: "sum.requests"},
+				{Name: "cloudflare_zone_bandwidth_daily_bytes_total", Help: "Total bandwidth in bytes, counted per completed day",
+					Field: "sum.bytes"},
+				{Name: "cloudflare_zone_threats_daily_total", Help: "Total number of threats, counted per completed day",
+					Field: "sum.threats"},
+				{Name: "cloudflare_zone_pageviews_daily_total", Help: "Total number of page views, counted per completed day",
+					Field: "sum.pageViews"},
+				{Name: "cloudflare_zone_requests_yesterday", Help: "Number of requests (last completed day, UTC)",
+					Type: metricGauge, Field: "sum.requests"},
+				{Name: "cloudflare_zone_bandwidth_yesterday_bytes", Help: "Bandwidth in bytes (last completed day, UTC)",
+					Type: metricGauge, Field: "sum.bytes"},
+				{Name: "cloudflare_zone_threats_yesterday", Help: "Number of threats (last completed day, UTC)",
+					Type: metricGauge, Field: "sum.threats"},
+				{Name: "cloudflare_zone_pageviews_yesterday", Help: "Number of page views (last completed day, UTC)",
+					Type: metricGauge, Field: "sum.pageViews"},
+				{Name: "cloudflare_zone_unique_visitors_yesterday", Help: "Number of unique visitors (last completed day, UTC)",
+					Type: metricGauge, Field: "uniq.uniques"},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: per-request dimensions (cache, protocol, SSL)
+			Name:    "http_requests_adaptive",
+			Node:    "httpRequestsAdaptiveGroups",
+			Limit:   5000,
+			OrderBy: "count_DESC",
+			Primary: true,
+			Labels: []DatasetLabel{
+				{Name: "cache_status", Field: "dimensions.cacheStatus", Skip: []string{""}},
+				{Name: "protocol", Field: "dimensions.clientRequestHTTPProtocol", Skip: []string{""}},
+				{Name: "ssl_protocol", Field: "dimensions.clientSSLProtocol", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_requests_total", Help: "Total number of HTTP requests", Field: "count"},
+				{Name: "cloudflare_zone_requests_cached", Help: "Number of cached HTTP requests", Field: "count",
+					Match: map[string][]string{"cache_status": cacheHitStatuses}},
+				{Name: "cloudflare_zone_requests_encrypted", Help: "Number of SSL/TLS encrypted HTTP requests", Field: "count",
+					Exclude: map[string][]string{"ssl_protocol": {"", "none"}}},
+				{Name: "cloudflare_zone_bandwidth_total_bytes", Help: "Total bandwidth in bytes", Field: "sum.edgeResponseBytes"},
+				{Name: "cloudflare_zone_bandwidth_cached_bytes", Help: "Cached bandwidth in bytes", Field: "sum.edgeResponseBytes",
+					Match: map[string][]string{"cache_status": cacheHitStatuses}},
+				{Name: "cloudflare_zone_bandwidth_encrypted_bytes", Help: "SSL/TLS encrypted bandwidth in bytes", Field: "sum.edgeResponseBytes",
+					Exclude: map[string][]string{"ssl_protocol": {"", "none"}}},
+				{Name: "cloudflare_zone_request_bytes_total", Help: "Total inbound request bytes (client to edge)", Field: "sum.edgeRequestBytes"},
+				{Name: "cloudflare_zone_requests_cache_status", Help: "Number of requests by cache status (hit, miss, dynamic, etc.)",
+					Field: "count", Labels: []string{"cache_status"}},
+				{Name: "cloudflare_zone_requests_http_protocol", Help: "Number of requests by HTTP protocol version",
+					Field: "count", Labels: []string{"protocol"}},
+				{Name: "cloudflare_zone_requests_ssl_protocol", Help: "Number of requests by SSL/TLS protocol version",
+					Field: "count", Labels: []string{"ssl_protocol"}},
+				{Name: "cloudflare_zone_origin_offload_ratio", Help: "Share of requests served from cache (last window)",
+					Type: metricGauge, Field: "count", Per: "cloudflare_zone_requests_total",
+					Match: map[string][]string{"cache_status": cacheHitStatuses}},
+				{Name: "cloudflare_zone_origin_offload_bytes_ratio", Help: "Share of bandwidth served from cache (last window)",
+					Type: metricGauge, Field: "sum.edgeResponseBytes", Per: "cloudflare_zone_bandwidth_total_bytes",
+					Match: map[string][]string{"cache_status": cacheHitStatuses}},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: Tiered Cache, hits by tier
+			Name:     "tiered_cache",
+			Node:     "httpRequestsAdaptiveGroups",
+			Limit:    5000,
+			OrderBy:  "count_DESC",
+			Optional: true,
+			OptIn:    true, // one more query per zone and scrape
+			Labels: []DatasetLabel{
+				{Name: "cache_status", Field: "dimensions.cacheStatus", Skip: []string{""}},
+				{Name: "upper_tier", Field: "dimensions.upperTierColoName", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_cache_hits_lower_tier", Help: "Number of cache hits served by the lower tier data center",
+					Field: "count", Match: map[string][]string{"cache_status": cacheHitStatuses, "upper_tier": {""}}},
+				{Name: "cloudflare_zone_cache_hits_upper_tier", Help: "Number of cache hits served through an upper tier data center",
+					Field: "count", Match: map[string][]string{"cache_status": cacheHitStatuses},
+					Exclude: map[string][]string{"upper_tier": {""}}},
+				{Name: "cloudflare_zone_requests_upper_tier", Help: "Number of requests forwarded to an upper tier by upper tier data center and cache status",
+					Field: "count", Labels: []string{"upper_tier", "cache_status"}},
+			},
+		},
+		{
+			// cacheReserveOperationsAdaptiveGroups: Cache Reserve reads and writes (Cache Reserve add-on)
+			Name:     "cache_reserve_operations",
+			Node:     "cacheReserveOperationsAdaptiveGroups",
+			Limit:    1000,
+			OrderBy:  "sum_requests_DESC",
+			Optional: true,
+			Labels: []DatasetLabel{
+				{Name: "operation_class", Field: "dimensions.operationClass", Skip: []string{""}},
+				{Name: "action", Field: "dimensions.actionStatus", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_cache_reserve_operations", Help: "Number of Cache Reserve operations by class (A: writes, B: reads) and action",
+					Field: "sum.requests", Labels: []string{"operation_class", "action"}},
+			},
+		},
+		{
+			// cacheReserveStorageAdaptiveGroups: Cache Reserve storage (Cache Reserve add-on)
+			Name:     "cache_reserve_storage",
+			Node:     "cacheReserveStorageAdaptiveGroups",
+			Limit:    1,
+			Interval: 15 * time.Minute, // storage is sampled, not per request
+			Optional: true,
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_cache_reserve_stored_bytes", Help: "Bytes stored in Cache Reserve (maximum in the last window)",
+					Type: metricGauge, Field: "max.storedBytes"},
+				{Name: "cloudflare_zone_cache_reserve_objects", Help: "Number of objects stored in Cache Reserve (maximum in the last window)",
+					Type: metricGauge, Field: "max.objectCount"},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: security, device, browser, OS, origin status
+			Name:    "http_security",
+			Node:    "httpRequestsAdaptiveGroups",
+			Limit:   5000,
+			OrderBy: "count_DESC",
+			Labels: []DatasetLabel{
+				{Name: "action", Field: "dimensions.securityAction", Skip: []string{"", "unknown"}},
+				{Name: "source", Field: "dimensions.securitySource", Skip: []string{"", "unknown"}},
+				{Name: "device_type", Field: "dimensions.clientDeviceType", Skip: []string{""}},
+				{Name: "browser", Field: "dimensions.userAgentBrowser", Skip: []string{""}},
+				{Name: "os", Field: "dimensions.userAgentOS", Skip: []string{""}},
+				{Name: "status", Field: "dimensions.originResponseStatus", Skip: []string{"", "0"}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_requests_security_action", Help: "Number of requests by security action (block, managed_challenge, etc.)",
+					Field: "count", Labels: []string{"action"}},
+				{Name: "cloudflare_zone_requests_security_source", Help: "Number of requests by security source (botFight, waf, firewall, etc.)",
+					Field: "count", Labels: []string{"source"}},
+				{Name: "cloudflare_zone_requests_device_type", Help: "Number of requests by client device type (desktop, mobile, etc.)",
+					Field: "count", Labels: []string{"device_type"}},
+				{Name: "cloudflare_zone_requests_browser", Help: "Number of requests by browser family",
+					Field: "count", Labels: []string{"browser"}},
+				{Name: "cloudflare_zone_requests_os", Help: "Number of requests by client operating system",
+					Field: "count", Labels: []string{"os"}},
+				{Name: "cloudflare_zone_requests_origin_status", Help: "Number of requests by origin server response status code",
+					Field: "count", Labels: []string{"status"}},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: by HTTP status code
+			Name:    "http_status",
+			Node:    "httpRequestsAdaptiveGroups",
+			Limit:   1000,
+			OrderBy: "count_DESC",
+			Labels: []DatasetLabel{
+				{Name: "status", Field: "dimensions.edgeResponseStatus", Skip: []string{"", "0"}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_requests_status", Help: "Number of requests by HTTP response status code",
+					Field: "count", Labels: []string{"status"}, Exemplars: true},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: by client country
+			Name:    "http_country",
+			Node:    "httpRequestsAdaptiveGroups",
+			Limit:   5000,
+			OrderBy: "count_DESC",
+			Labels: []DatasetLabel{
+				{Name: "country", Field: "dimensions.clientCountryName", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_requests_country", Help: "Number of requests by client country",
+					Field: "count", Labels: []string{"country"}},
+				{Name: "cloudflare_zone_bandwidth_country_bytes", Help: "Bandwidth by client country in bytes",
+					Field: "sum.edgeResponseBytes", Labels: []string{"country"}},
+			},
+		},
+		{
+			// dnsAnalyticsAdaptiveGroups: DNS query analytics
+			Name:    "dns",
+			Node:    "dnsAnalyticsAdaptiveGroups",
+			Limit:   5000,
+			OrderBy: "count_DESC",
+			Labels: []DatasetLabel{
+				{Name: "query_name", Field: "dimensions.queryName"},
+				{Name: "query_type", Field: "dimensions.queryType"},
+				{Name: "response_code", Field: "dimensions.responseCode"},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_dns_queries", Help: "Number of DNS queries",
+					Field: "count", Labels: []string{"query_name", "query_type", "response_code"}},
+			},
+		},
+		{
+			// firewallEventsAdaptiveGroups: WAF/Firewall (requires Pro+ plan)
+			Name:     "firewall",
+			Node:     "firewallEventsAdaptiveGroups",
+			Limit:    5000,
+			OrderBy:  "count_DESC",
+			Optional: true,
+			Labels: []DatasetLabel{
+				{Name: "action", Field: "dimensions.action", Skip: []string{""}},
+				{Name: "source", Field: "dimensions.source", Skip: []string{""}},
+				{Name: "country", Field: "dimensions.clientCountryName", Skip: []string{""}},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_firewall_events_action", Help: "Number of firewall events by action (block, challenge, etc.)",
+					Field: "count", Labels: []string{"action"}},
+				{Name: "cloudflare_zone_firewall_events_source", Help: "Number of firewall events by source (waf, firewallRules, rateLimit, etc.)",
+					Field: "count", Labels: []string{"source"}},
+				{Name: "cloudflare_zone_firewall_events_country", Help: "Number of firewall events by client country",
+					Field: "count", Labels: []string{"country"}},
+			},
+		},
+		{
+			// healthCheckEventsAdaptiveGroups: Health checks (requires Pro+ plan)
+			Name:     "health_checks",
+			Node:     "healthCheckEventsAdaptiveGroups",
+			Limit:    1000,
+			OrderBy:  "count_DESC",
+			Optional: true,
+			Labels: []DatasetLabel{
+				{Name: "status", Field: "dimensions.healthStatus"},
+				{Name: "origin_ip", Field: "dimensions.originIP"},
+				{Name: "health_check_name", Field: "dimensions.healthCheckName"},
+				{Name: "region", Field: "dimensions.region"},
+			},
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_health_check_events", Help: "Number of health check events",
+					Field: "count", Labels: []string{"status", "origin_ip", "health_check_name", "region"}},
+			},
+		},
+		{
+			// httpRequestsAdaptiveGroups: latency quantiles as histograms
+			Name:     "http_latency",
+			Node:     "httpRequestsAdaptiveGroups",
+			Limit:    1,
+			Optional: true,
+			OptIn:    true, // one more query per zone and scrape
+			Metrics: []DatasetMetric{
+				{Name: "cloudflare_zone_edge_ttfb_seconds", Help: "Edge time to first byte in seconds (estimated from quantiles)",
+					Type: metricHistogram, Field: "count", Scale: 0.001, Avg: "avg.edgeTimeToFirstByteMs",
+					Quantiles: map[float64]string{
+						0.5:   "quantiles.edgeTimeToFirstByteMsP50",
+						0.75:  "quantiles.edgeTimeToFirstByteMsP75",
+						0.9:   "quantiles.edgeTimeToFirstByteMsP90",
+						0.95:  "quantiles.edgeTimeToFirstByteMsP95",
+						0.99:  "quantiles.edgeTimeToFirstByteMsP99",
+						0.999: "quantiles.edgeTimeToFirstByteMsP999",
+					}},
+				{Name: "cloudflare_zone_origin_response_duration_seconds", Help: "Origin response duration in seconds (estimated from quantiles)",
+					Type: metricHistogram, Field: "count", Scale: 0.001, Avg: "avg.originResponseDurationMs",
+					Quantiles: map[float64]string{
+						0.5:   "quantiles.originResponseDurationMsP50",
+						0.75:  "quantiles.originResponseDurationMsP75",
+						0.9:   "quantiles.originResponseDurationMsP90",
+						0.95:  "quantiles.originResponseDurationMsP95",
+						0.99:  "quantiles.originResponseDurationMsP99",
+						0.999: "quantiles.originResponseDurationMsP999",
+					}},
+			},
+		},
+	}
+}
+
+// mergeDatasets overlays custom datasets on the built-in ones by name and
+// validates the result.
+func mergeDatasets(builtin, custom []*Dataset) ([]*Dataset, error) {
+	merged := append([]*Dataset(nil), builtin...)
+	index := make(map[string]int, len(merged))
+	for i, ds := range merged {
+		index[ds.Name] = i
+	}
+	for _, ds := range custom {
+		if i, ok := index[ds.Name]; ok {
+			merged[i] = ds
+			continue
+		}
+		index[ds.Name] = len(merged)
+		merged = append(merged, ds)
+	}
+
+	metricNames := make(map[string]string)
+	for _, ds := range merged {
+		if err := ds.validate(); err != nil {
+			return nil, err
+		}
+		for _, m := range ds.Metrics {
+			if other, ok := metricNames[m.Name]; ok {
+				return nil, fmt.Errorf("dataset %q: metric %q already defined by dataset %q", ds.Name, m.Name, other)
+			}
+			metricNames[m.Name] = ds.Name
+		}
+	}
+	return merged, nil
+}
+
+// selectDatasets removes the disabled datasets and opt-in datasets not
+// enabled.
+func selectDatasets(datasets []*Dataset, enable, disable []string) ([]*Dataset, error) {
+	known := make(map[string]bool, len(datasets))
+	for _, ds := range datasets {
+		known[ds.Name] = true
+	}
+	for _, name := range enable {
+		if !known[name] {
+			return nil, fmt.Errorf("cannot enable unknown dataset %q", name)
+		}
+	}
+	for _, name := range disable {
+		if !known[name] {
+			return nil, fmt.Errorf("cannot disable unknown dataset %q", name)
+		}
+	}
+	var selected []*Dataset
+	for _, ds := range datasets {
+		if !slices.Contains(disable, ds.Name) && (!ds.OptIn || slices.Contains(enable, ds.Name)) {
+			selected = append(selected, ds)
+		}
+	}
+	return selected, nil
+}
+
+// setIntervals sets the interval of the named datasets.
+func setIntervals(datasets []*Dataset, intervals map[string]time.Duration) error {
+	for name, interval := range intervals {
+		var found *Dataset
+		for _, ds := range datasets {
+			if ds.Name == name {
+				found = ds
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("interval for unknown dataset %q", name)
+		}
+		found.Interval = interval
+		if err := found.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// validate checks a dataset definition and fills in defaults.
+func (ds *Dataset) validate() error {
+	if ds.Name == "" {
+		return fmt.Errorf("dataset without name")
+	}
+	if ds.Query != "" {
+		if ds.Path == "" {
+			return fmt.Errorf("dataset %q: path is required with a custom query", ds.Name)
+		}
+		if _, err := parsePath(ds.Path); err != nil {
+			return fmt.Errorf("dataset %q: %w", ds.Name, err)
+		}
+	} else if ds.Node == "" {
+		return fmt.Errorf("dataset %q: node or query is required", ds.Name)
+	}
+	switch ds.Scope {
+	case "":
+		ds.Scope = scopeZone
+	case scopeZone, scopeAccount:
+	default:
+		return fmt.Errorf("dataset %q: invalid scope %q", ds.Name, ds.Scope)
+	}
+	switch ds.Window {
+	case "":
+		ds.Window = windowAdaptive
+	case windowAdaptive, windowHourly, windowDaily:
+	default:
+		return fmt.Errorf("dataset %q: invalid window %q", ds.Name, ds.Window)
+	}
+	if ds.Limit <= 0 {
+		ds.Limit = 1000
+	}
+	if bucket := ds.bucket(); bucket > 0 {
+		// Pages of hourly and daily datasets are continued from their
+		// oldest bucket
+		order := ds.timeField() + "_DESC"
+		if ds.OrderBy == "" {
+			ds.OrderBy = order
+		}
+		if !strings.HasPrefix(ds.OrderBy, order) {
+			return fmt.Errorf("dataset %q: %s windows must be ordered by %s first", ds.Name, ds.Window, order)
+		}
+	}
+	if ds.Interval < 0 || (ds.Interval > 0 && ds.Window != windowAdaptive) {
+		return fmt.Errorf("dataset %q: interval must be positive and is only supported for adaptive windows", ds.Name)
+	}
+	if ds.MaxWindow == 0 {
+		// Adaptive datasets allow about a day per query, but the limit on
+		// groups is reached sooner; hourly and daily ones return one group
+		// per bucket, and a full page is continued with another query
+		ds.MaxWindow = time.Hour
+		if bucket := ds.bucket(); bucket > 0 {
+			ds.MaxWindow = time.Duration(max(ds.Limit-1, 1)) * bucket
+		}
+	}
+	if ds.MaxWindow < 0 || (ds.bucket() > 0 && ds.MaxWindow%ds.bucket() != 0) {
+		return fmt.Errorf("dataset %q: max_window must be positive and a multiple of a bucket for %s windows", ds.Name, ds.Window)
+	}
+
+	labels := make(map[string]bool, len(ds.Labels))
+	for i := range ds.Labels {
+		l := &ds.Labels[i]
+		if !labelNameRE.MatchString(l.Name) || l.Name == ds.scopeLabel() || reservedLabels[l.Name] {
+			return fmt.Errorf("dataset %q: invalid label name %q", ds.Name, l.Name)
+		}
+		if labels[l.Name] {
+			return fmt.Errorf("dataset %q: duplicate label %q", ds.Name, l.Name)
+		}
+		if l.Field == "" {
+			return fmt.Errorf("dataset %q: label %q has no field", ds.Name, l.Name)
+		}
+		field, err := ds.fieldPath(l.Field)
+		if err != nil {
+			return fmt.Errorf("dataset %q: label %q: %w", ds.Name, l.Name, err)
+		}
+		l.Field = field
+		labels[l.Name] = true
+	}
+
+	if len(ds.Metrics) == 0 {
+		return fmt.Errorf("dataset %q: no metrics defined", ds.Name)
+	}
+	for i := range ds.Metrics {
+		m := &ds.Metrics[i]
+		if !metricNameRE.MatchString(m.Name) {
+			return fmt.Errorf("dataset %q: invalid metric name %q", ds.Name, m.Name)
+		}
+		switch m.Type {
+		case "":
+			m.Type = metricCounter
+		case metricCounter, metricGauge:
+		case metricHistogram:
+			if err := ds.validateHistogram(m); err != nil {
+				return fmt.Errorf("dataset %q: metric %q: %w", ds.Name, m.Name, err)
+			}
+		default:
+			return fmt.Errorf("dataset %q: metric %q: invalid type %q", ds.Name, m.Name, m.Type)
+		}
+		if m.Scale == 0 {
+			m.Scale = 1
+		}
+		if m.Field == "" {
+			return fmt.Errorf("dataset %q: metric %q has no field", ds.Name, m.Name)
+		}
+		field, err := ds.fieldPath(m.Field)
+		if err != nil {
+			return fmt.Errorf("dataset %q: metric %q: %w", ds.Name, m.Name, err)
+		}
+		m.Field = field
+		if m.Help == "" {
+			source := ds.Node
+			if source == "" {
+				source = ds.Name
+			}
+			m.Help = fmt.Sprintf("%s from %s", m.Field, source)
+		}
+		if m.Each != "" {
+			each, err := normalizePath(m.Each)
+			if err == nil {
+				// The array itself is selected, its entries are iterated
+				each = strings.TrimSuffix(each, ".*")
+				if ds.Query == "" {
+					err = checkSelectable(each)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("dataset %q: metric %q: %w", ds.Name, m.Name, err)
+			}
+			m.Each = each
+		}
+		if m.Each != "" && !strings.HasPrefix(m.Field, m.Each+".") {
+			return fmt.Errorf("dataset %q: metric %q: field %q is not below %q", ds.Name, m.Name, m.Field, m.Each)
+		}
+		for _, l := range m.Labels {
+			if !labels[l] {
+				return fmt.Errorf("dataset %q: metric %q: unknown label %q", ds.Name, m.Name, l)
+			}
+		}
+		for l := range m.Match {
+			if !labels[l] {
+				return fmt.Errorf("dataset %q: metric %q: match on unknown label %q", ds.Name, m.Name, l)
+			}
+		}
+		for l := range m.Exclude {
+			if !labels[l] {
+				return fmt.Errorf("dataset %q: metric %q: exclude on unknown label %q", ds.Name, m.Name, l)
+			}
+		}
+		if m.Exemplars && (m.Type != metricCounter || ds.Scope != scopeZone || !slices.Contains(m.Labels, exemplarLabel)) {
+			return fmt.Errorf("dataset %q: metric %q: exemplars require a zone counter with label %q", ds.Name, m.Name, exemplarLabel)
+		}
+	}
+	for i := range ds.Metrics {
+		if err := ds.validateRatio(&ds.Metrics[i]); err != nil {
+			return fmt.Errorf("dataset %q: metric %q: %w", ds.Name, ds.Metrics[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// fieldPath normalizes the path of a group field. Generated queries select
+// the fields by name, so they only support plain field names.
+func (ds *Dataset) fieldPath(path string) (string, error) {
+	field, err := normalizePath(path)
+	if err != nil {
+		return "", err
+	}
+	if ds.Query == "" {
+		if err := checkSelectable(field); err != nil {
+			return "", err
+		}
+	}
+	return field, nil
+}
+
+// validateRatio checks the metric a ratio metric divides by.
+func (ds *Dataset) validateRatio(m *DatasetMetric) error {
+	if m.Per == "" {
+		return nil
+	}
+	if m.Type != metricGauge {
+		return fmt.Errorf("per requires type gauge")
+	}
+	for i := range ds.Metrics {
+		per := &ds.Metrics[i]
+		if per.Name != m.Per {
+			continue
+		}
+		if per == m || per.Per != "" || per.Type == metricHistogram {
+			return fmt.Errorf("per %q must be another counter or gauge", m.Per)
+		}
+		if !slices.Equal(per.Labels, m.Labels) {
+			return fmt.Errorf("per %q has different labels", m.Per)
+		}
+		return nil
+	}
+	return fmt.Errorf("per on unknown metric %q", m.Per)
+}
+
+// reservedLabels are added by the exporter: "account" carries the credential
+// name with credentials from the config file, "dataset" tags InfluxDB points.
+var reservedLabels = map[string]bool{"account": true, "dataset": true}
+
+// scopeLabel is the label identifying the zone or account a series belongs to.
+func (ds *Dataset) scopeLabel() string {
+	if ds.Scope == scopeAccount {
+		return "account_id"
+	}
+	return "zone"
+}
+
+func (ds *Dataset) label(name string) *DatasetLabel {
+	for i := range ds.Labels {
+		if ds.Labels[i].Name == name {
+			return &ds.Labels[i]
+		}
+	}
+	return nil
+}
+
+// bucket is the length of the buckets an hourly or daily dataset's groups
+// are aggregated in, 0 for adaptive datasets.
+func (ds *Dataset) bucket() time.Duration {
+	switch ds.Window {
+	case windowHourly:
+		return time.Hour
+	case windowDaily:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// timeField is the field windows are filtered and ordered by.
+func (ds *Dataset) timeField() string {
+	if ds.Window == windowDaily {
+		return "date"
+	}
+	return "datetime"
+}
+
+// timeFormat is the format of window bounds and buckets in queries.
+func (ds *Dataset) timeFormat() string {
+	if ds.Window == windowDaily {
+		return time.DateOnly
+	}
+	return time.RFC3339
+}
+
+// bucketField is the group field holding the bucket of an hourly or daily
+// dataset, which the collector uses to count each bucket once and take
+// gauges from the newest.
+func (ds *Dataset) bucketField() string {
+	return "dimensions." + ds.timeField()
+}
+
+// fields lists every group field the dataset reads, in definition order.
+func (ds *Dataset) fields() []string {
+	var fields []string
+	if ds.bucket() > 0 {
+		fields = append(fields, ds.bucketField())
+	}
+	for _, l := range ds.Labels {
+		fields = append(fields, l.Field)
+	}
+	for _, m := range ds.Metrics {
+		fields = append(fields, m.Field)
+		for _, q := range m.quantiles() {
+			fields = append(fields, m.Quantiles[q])
+		}
+		if m.Avg != "" {
+			fields = append(fields, m.Avg)
+		}
+	}
+	return fields
+}
+
+// validateHistogram checks and normalizes the histogram options of a metric.
+func (ds *Dataset) validateHistogram(m *DatasetMetric) error {
+	if len(m.Quantiles) == 0 {
+		return fmt.Errorf("histogram without quantiles")
+	}
+	quantiles := make(map[float64]string, len(m.Quantiles))
+	for q, field := range m.Quantiles {
+		if q <= 0 || q > 1 {
+			return fmt.Errorf("quantile %v out of range (0, 1]", q)
+		}
+		field, err := ds.fieldPath(field)
+		if err != nil {
+			return err
+		}
+		quantiles[q] = field
+	}
+	m.Quantiles = quantiles
+	if m.Avg != "" {
+		avg, err := ds.fieldPath(m.Avg)
+		if err != nil {
+			return err
+		}
+		m.Avg = avg
+	}
+	if len(m.Buckets) == 0 {
+		m.Buckets = prometheus.DefBuckets
+	}
+	if !sort.Float64sAreSorted(m.Buckets) {
+		return fmt.Errorf("buckets must be sorted")
+	}
+	return nil
+}
+
+// quantiles returns the metric's quantiles in ascending order.
+func (m *DatasetMetric) quantiles() []float64 {
+	qs := make([]float64, 0, len(m.Quantiles))
+	for q := range m.Quantiles {
+		qs = append(qs, q)
+	}
+	sort.Float64s(qs)
+	return qs
+}
+
+// bucketCounts estimates cumulative bucket counts for count observations
+// from their quantiles by interpolating the CDF linearly between quantile
+// points, starting at (0, 0). Bounds above the highest quantile get that
+// quantile's share; the remainder only shows up in +Inf (the count).
+func (m *DatasetMetric) bucketCounts(count float64, values map[float64]float64) []float64 {
+	qs := m.quantiles()
+	counts := make([]float64, len(m.Buckets))
+	for i, bound := range m.Buckets {
+		prevValue, prevQ, cdf := 0.0, 0.0, 0.0
+		for _, q := range qs {
+			v := values[q]
+			if v < prevValue {
+				v = prevValue // keep the CDF monotonic on noisy samples
+			}
+			if bound < v {
+				if v > prevValue {
+					cdf = prevQ + (q-prevQ)*(bound-prevValue)/(v-prevValue)
+				} else {
+					cdf = prevQ
+				}
+				break
+			}
+			prevValue, prevQ, cdf = v, q, q
+		}
+		if bound < 0 {
+			cdf = 0
+		}
+		counts[i] = count * cdf
+	}
+	return counts
+}
+
+// --- group field access ---
+
+// lookupField resolves a path like "sum.edgeResponseBytes" in a group,
+// returning the first match.
+func lookupField(v interface{}, path string) interface{} {
+	if matches := evalPath(v, path); len(matches) > 0 {
+		return matches[0]
+	}
+	return nil
+}
+
+// fieldValue resolves path against the entry being iterated when it lies
+// below the metric's Each array, and against the group otherwise.
+func (m *DatasetMetric) fieldValue(group, entry map[string]interface{}, path string) interface{} {
+	if m.Each != "" && strings.HasPrefix(path, m.Each+".") {
+		return lookupField(entry, strings.TrimPrefix(path, m.Each+"."))
+	}
+	return lookupField(group, path)
+}
+
+// entries returns the values a metric iterates over for one group.
+func (m *DatasetMetric) entries(group map[string]interface{}) []map[string]interface{} {
+	if m.Each == "" {
+		return []map[string]interface{}{group}
+	}
+	arr, _ := lookupField(group, m.Each).([]interface{})
+	return objects(arr)
+}
+
+// objects keeps the JSON objects of a list of values.
+func objects(values []interface{}) []map[string]interface{} {
+	entries := make([]map[string]interface{}, 0, len(values))
+	for _, e := range values {
+		if obj, ok := e.(map[string]interface{}); ok {
+			entries = append(entries, obj)
+		}
+	}
+	return entries
+}
+
+// groupBucket returns the bucket of a group of an hourly or daily dataset.
+func (ds *Dataset) groupBucket(group map[string]interface{}) (time.Time, bool) {
+	s, _ := lookupField(group, ds.bucketField()).(string)
+	bucket, err := time.Parse(ds.timeFormat(), s)
+	return bucket, err == nil
+}
+
+// labelString formats a field value as a label value.
+func labelString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// numberValue formats a field value as a sample value.
+func numberValue(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// labelValues returns the metric's label values for an entry, or false if the
+// entry is filtered out by Skip, Match or Exclude.
+func (ds *Dataset) labelValues(m *DatasetMetric, group, entry map[string]interface{}) ([]string, bool) {
+	for name, allowed := range m.Match {
+		if !slices.Contains(allowed, labelString(m.fieldValue(group, entry, ds.label(name).Field))) {
+			return nil, false
+		}
+	}
+	for name, excluded := range m.Exclude {
+		if slices.Contains(excluded, labelString(m.fieldValue(group, entry, ds.label(name).Field))) {
+			return nil, false
+		}
+	}
+	values := make([]string, len(m.Labels))
+	for i, name := range m.Labels {
+		l := ds.label(name)
+		values[i] = labelString(m.fieldValue(group, entry, l.Field))
+		if slices.Contains(l.Skip, values[i]) {
+			return nil, false
+		}
+	}
+	return values, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucketCounts(t *testing.T) {
+	m := &DatasetMetric{
+		Quantiles: map[float64]string{0.5: "p50", 0.9: "p90", 0.99: "p99"},
+		Buckets:   []float64{-1, 50, 100, 150, 200, 500, 1000},
+	}
+	tests := []struct {
+		name   string
+		count  float64
+		values map[float64]float64
+		want   []float64
+	}{
+		{
+			name:   "interpolated",
+			count:  100,
+			values: map[float64]float64{0.5: 100, 0.9: 200, 0.99: 500},
+			// Below the first quantile the CDF rises linearly from 0; bounds
+			// above the top quantile stay at it, the rest is in +Inf
+			want: []float64{0, 25, 50, 70, 90, 99, 99},
+		},
+		{
+			name:   "zero count",
+			count:  0,
+			values: map[float64]float64{0.5: 100, 0.9: 200, 0.99: 500},
+			want:   []float64{0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:   "non-monotonic quantiles",
+			count:  100,
+			values: map[float64]float64{0.5: 200, 0.9: 100, 0.99: 100},
+			want:   []float64{0, 12.5, 25, 37.5, 99, 99, 99},
+		},
+		{
+			name:   "equal quantiles",
+			count:  10,
+			values: map[float64]float64{0.5: 100, 0.9: 100, 0.99: 100},
+			want:   []float64{0, 2.5, 9.9, 9.9, 9.9, 9.9, 9.9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.bucketCounts(tt.count, tt.values)
+			for i := range got {
+				got[i] = roundTo(got[i], 1e-9)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bucketCounts = %v, want %v", got, tt.want)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i] < got[i-1] {
+					t.Errorf("bucket %d (%v) below bucket %d (%v)", i, got[i], i-1, got[i-1])
+				}
+			}
+			if top := got[len(got)-1]; top > tt.count {
+				t.Errorf("top bucket %v exceeds count %v", top, tt.count)
+			}
+		})
+	}
+}
+
+func roundTo(v, precision float64) float64 {
+	return float64(int64(v/precision+0.5)) * precision
+}
+
+func TestSelectDatasets(t *testing.T) {
+	datasets := []*Dataset{{Name: "a"}, {Name: "b"}, {Name: "latency", OptIn: true}}
+	tests := []struct {
+		name            string
+		enable, disable []string
+		want            []string
+		err             bool
+	}{
+		{"defaults", nil, nil, []string{"a", "b"}, false},
+		{"enable opt-in", []string{"latency"}, nil, []string{"a", "b", "latency"}, false},
+		{"disable", nil, []string{"a"}, []string{"b"}, false},
+		{"disable wins", []string{"latency"}, []string{"latency"}, []string{"a", "b"}, false},
+		{"unknown enable", []string{"x"}, nil, nil, true},
+		{"unknown disable", nil, []string{"x"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := selectDatasets(datasets, tt.enable, tt.disable)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			var names []string
+			for _, ds := range selected {
+				names = append(names, ds.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("selected %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
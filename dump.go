@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sync"
+	"time"
+)
+
+var dumpFlag = flag.String("dump", "", "write every fetched window as JSON lines to this file, - for stdout (default $DUMP_FILE)")
+
+// dumpRecord is one fetched window of one dataset, as returned by the API.
+type dumpRecord struct {
+	Scope     string                   `json:"scope"`
+	ID        string                   `json:"id"`
+	Dataset   string                   `json:"dataset"`
+	Since     time.Time                `json:"since"`
+	Until     time.Time                `json:"until"`
+	FetchedAt time.Time                `json:"fetched_at"`
+	Groups    []map[string]interface{} `json:"groups"`
+}
+
+// dumper appends fetched windows as JSON lines. Zones are collected
+// concurrently, so writes are serialized and flushed per record.
+type dumper struct {
+	mu sync.Mutex
+	w  *bufio.Writer // nil once closed
+	f  *os.File      // nil for stdout
+}
+
+// newDumper opens the dump target, appending to an existing file.
+func newDumper(path string) (*dumper, error) {
+	if path == "-" {
+		return &dumper{w: bufio.NewWriter(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &dumper{w: bufio.NewWriter(f), f: f}, nil
+}
+
+func (d *dumper) write(r dumpRecord) error {
+	if r.Groups == nil {
+		r.Groups = []map[string]interface{}{}
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil {
+		return os.ErrClosed
+	}
+	d.w.Write(line)
+	d.w.WriteByte('\n')
+	return d.w.Flush()
+}
+
+// Close flushes and syncs the dump file and closes it. Later writes fail.
+func (d *dumper) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil {
+		return nil
+	}
+	err := d.w.Flush()
+	d.w = nil
+	if d.f != nil {
+		err = errors.Join(err, d.f.Sync(), d.f.Close())
+	}
+	return err
+}
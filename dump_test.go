@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpFormat(t *testing.T) {
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	var out strings.Builder
+	d := &dumper{w: bufio.NewWriter(&out)}
+	records := []dumpRecord{
+		{Scope: scopeZone, ID: "z1", Dataset: "http_status", Since: since, Until: since.Add(time.Minute), FetchedAt: since.Add(6 * time.Minute),
+			Groups: []map[string]interface{}{{"count": 3.0, "dimensions": map[string]interface{}{"edgeResponseStatus": 200.0}}}},
+		{Scope: scopeAccount, ID: "a1", Dataset: "workers", Since: since, Until: since.Add(time.Minute), FetchedAt: since.Add(6 * time.Minute)},
+	}
+	for _, r := range records {
+		if err := d.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"scope":"zone","id":"z1","dataset":"http_status","since":"2026-01-01T10:00:00Z","until":"2026-01-01T10:01:00Z","fetched_at":"2026-01-01T10:06:00Z","groups":[{"count":3,"dimensions":{"edgeResponseStatus":200}}]}
+{"scope":"account","id":"a1","dataset":"workers","since":"2026-01-01T10:00:00Z","until":"2026-01-01T10:01:00Z","fetched_at":"2026-01-01T10:06:00Z","groups":[]}
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestDumpAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	for i := range 2 {
+		d, err := newDumper(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.write(dumpRecord{Scope: scopeZone, ID: "z1", Dataset: fmt.Sprint("d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.write(dumpRecord{Scope: scopeZone, ID: "z1", Dataset: "closed"}); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("write after close = %v, want %v", err, os.ErrClosed)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), b)
+	}
+	for i, line := range lines {
+		var r dumpRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if want := fmt.Sprint("d", i); r.Dataset != want {
+			t.Errorf("line %d: dataset %q, want %q", i, r.Dataset, want)
+		}
+	}
+}
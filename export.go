@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON and InfluxDB line protocol endpoints serve the collector state as
+// of the last collection (scrape or poll); they never query Cloudflare.
+
+// lookupTarget returns a configured zone or account.
+func (c *CloudflareCollector) lookupTarget(scope, id string) (target, bool) {
+	for _, t := range c.targets {
+		if t.scope == scope && t.id == id {
+			return t, true
+		}
+	}
+	return target{}, false
+}
+
+// lookupState returns the state of a configured zone or account, if it was
+// collected at least once.
+func (c *CloudflareCollector) lookupState(scope, id string) (*zoneState, bool) {
+	if _, ok := c.lookupTarget(scope, id); !ok {
+		return nil, false
+	}
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	zs, ok := c.zones[scope+"/"+id]
+	return zs, ok
+}
+
+// seriesLabels pairs a metric's label names with the values in a counter key.
+func seriesLabels(m *DatasetMetric, key string) map[string]string {
+	labels := make(map[string]string, len(m.Labels))
+	if len(m.Labels) == 0 {
+		return labels
+	}
+	for i, v := range strings.Split(key, "\x00") {
+		labels[m.Labels[i]] = v
+	}
+	return labels
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// --- JSON ---
+
+type apiTarget struct {
+	Scope    string       `json:"scope"`
+	ID       string       `json:"id"`
+	Account  string       `json:"account"` // credential name
+	Datasets []apiDataset `json:"datasets"`
+}
+
+type apiDataset struct {
+	Name    string      `json:"name"`
+	Window  *apiWindow  `json:"window,omitempty"`
+	Metrics []apiMetric `json:"metrics"`
+}
+
+type apiWindow struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+type apiMetric struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Series []apiSeries `json:"series"`
+}
+
+// apiSeries is one series: the accumulated value (counter total, gauge or
+// histogram count and sum) and its raw value in the last window.
+type apiSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Value   *float64          `json:"value,omitempty"`
+	Count   *float64          `json:"count,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Buckets []apiBucket       `json:"buckets,omitempty"`
+	Window  *float64          `json:"window,omitempty"`
+}
+
+type apiBucket struct {
+	LE    float64 `json:"le"`
+	Count float64 `json:"count"`
+}
+
+// targetJSON builds the JSON view of one zone or account. Callers hold zs.mu.
+func (c *CloudflareCollector) targetJSON(tg target, zs *zoneState) apiTarget {
+	t := apiTarget{Scope: tg.scope, ID: tg.id, Account: tg.cred.Name, Datasets: []apiDataset{}}
+	for _, ds := range c.datasets {
+		if ds.Scope != tg.scope {
+			continue
+		}
+		d := apiDataset{Name: ds.Name, Metrics: []apiMetric{}}
+		raw := zs.windows[ds.Name]
+		if raw != nil {
+			d.Window = &apiWindow{Since: raw.Since, Until: raw.Until}
+		}
+		for i := range ds.Metrics {
+			m := &ds.Metrics[i]
+			am := apiMetric{Name: m.Name, Type: m.Type, Series: []apiSeries{}}
+			if m.Type == metricHistogram {
+				hs := zs.histograms[m.Name]
+				for _, key := range sortedKeys(hs) {
+					h := *hs[key] // copied, encoded after zs.mu is released
+					s := apiSeries{Labels: seriesLabels(m, key), Count: &h.Count, Sum: &h.Sum}
+					for j, bound := range m.Buckets {
+						s.Buckets = append(s.Buckets, apiBucket{LE: bound, Count: math.Round(h.Buckets[j])})
+					}
+					if v, ok := raw.value(m.Name, key); ok {
+						s.Window = &v
+					}
+					am.Series = append(am.Series, s)
+				}
+			} else {
+				values := zs.counters[m.Name]
+				for _, key := range sortedKeys(values) {
+					v := values[key]
+					s := apiSeries{Labels: seriesLabels(m, key), Value: &v}
+					if w, ok := raw.value(m.Name, key); ok {
+						s.Window = &w
+					}
+					am.Series = append(am.Series, s)
+				}
+			}
+			d.Metrics = append(d.Metrics, am)
+		}
+		t.Datasets = append(t.Datasets, d)
+	}
+	return t
+}
+
+// value returns the raw window value of one series.
+func (w *window) value(metric, key string) (float64, bool) {
+	if w == nil {
+		return 0, false
+	}
+	v, ok := w.Values[metric][key]
+	return v, ok
+}
+
+// targetHandler serves /api/v1/zones/{id} and /api/v1/accounts/{id}.
+func (c *CloudflareCollector) targetHandler(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		tg, _ := c.lookupTarget(scope, id)
+		zs, ok := c.lookupState(scope, id)
+		if !ok {
+			http.Error(w, "unknown "+scope+" or not collected yet", http.StatusNotFound)
+			return
+		}
+		zs.mu.Lock()
+		t := c.targetJSON(tg, zs)
+		zs.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(t)
+	}
+}
+
+// --- InfluxDB line protocol ---
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func influxFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeInflux writes one line per series of a zone or account: the metric
+// name is the measurement, the scope label, dataset and metric labels are
+// tags, and the sample time is the end of the dataset's last window.
+// Callers hold zs.mu.
+func (c *CloudflareCollector) writeInflux(w *strings.Builder, t target, zs *zoneState) {
+	for _, ds := range c.datasets {
+		if ds.Scope != t.scope {
+			continue
+		}
+		end, ok := zs.windowEnd[ds.Name]
+		if !ok {
+			continue
+		}
+		raw := zs.windows[ds.Name]
+		line := func(m *DatasetMetric, key string, fields []string) {
+			if v, ok := raw.value(m.Name, key); ok {
+				fields = append(fields, "window="+influxFloat(v))
+			}
+			w.WriteString(influxMeasurementEscaper.Replace(m.Name))
+			tags := map[string]string{ds.scopeLabel(): t.id, "dataset": ds.Name}
+			if c.cfg.AccountLabel {
+				tags["account"] = t.cred.Name
+			}
+			for k, v := range seriesLabels(m, key) {
+				tags[k] = v
+			}
+			for _, k := range sortedKeys(tags) {
+				if tags[k] == "" {
+					continue // empty tag values are invalid
+				}
+				w.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+			}
+			w.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(end.UnixNano(), 10) + "\n")
+		}
+		for i := range ds.Metrics {
+			m := &ds.Metrics[i]
+			if m.Type == metricHistogram {
+				hs := zs.histograms[m.Name]
+				for _, key := range sortedKeys(hs) {
+					line(m, key, []string{"count=" + influxFloat(hs[key].Count), "sum=" + influxFloat(hs[key].Sum)})
+				}
+				continue
+			}
+			values := zs.counters[m.Name]
+			for _, key := range sortedKeys(values) {
+				line(m, key, []string{"value=" + influxFloat(values[key])})
+			}
+		}
+	}
+}
+
+// influxHandler serves /influx with every collected zone and account. The
+// lines of each are built under its lock and written after releasing it, so
+// a slow client doesn't hold up collection.
+func (c *CloudflareCollector) influxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, t := range c.targets {
+		zs, ok := c.lookupState(t.scope, t.id)
+		if !ok {
+			continue
+		}
+		var b strings.Builder
+		zs.mu.Lock()
+		c.writeInflux(&b, t, zs)
+		zs.mu.Unlock()
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func exportCollector(t *testing.T) *CloudflareCollector {
+	t.Helper()
+	c := testCollector(t, &Dataset{
+		Name: "requests", Node: "httpRequestsAdaptiveGroups",
+		Labels: []DatasetLabel{{Name: "host", Field: "dimensions.host"}},
+		Metrics: []DatasetMetric{
+			{Name: "requests_total", Field: "count", Labels: []string{"host"}},
+			{Name: "bytes_total", Field: "sum.bytes"},
+		},
+	})
+	c.cfg.AccountLabel = true
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	accumulate(c.getZoneState(scopeZone, "z1"), c.datasets[0], since, since.Add(time.Minute), []map[string]interface{}{
+		{"count": 2.0, "dimensions": map[string]interface{}{"host": "a b,c=d"}, "sum": map[string]interface{}{"bytes": 10.0}},
+		{"count": 1.0, "dimensions": map[string]interface{}{"host": ""}},
+	})
+	return c
+}
+
+func TestInfluxHandler(t *testing.T) {
+	c := exportCollector(t)
+	rec := httptest.NewRecorder()
+	c.influxHandler(rec, httptest.NewRequest(http.MethodGet, "/influx", nil))
+
+	// Tag values are escaped, empty ones left out
+	want := `requests_total,account=default,dataset=requests,zone=z1 value=1,window=1 1767261660000000000
+requests_total,account=default,dataset=requests,host=a\ b\,c\=d,zone=z1 value=2,window=2 1767261660000000000
+bytes_total,account=default,dataset=requests,zone=z1 value=10,window=10 1767261660000000000
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTargetHandler(t *testing.T) {
+	c := exportCollector(t)
+	c.targets = append(c.targets, target{scope: scopeZone, id: "z2", cred: c.targets[0].cred})
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/zones/{id}", c.targetHandler(scopeZone))
+	mux.Handle("GET /api/v1/accounts/{id}", c.targetHandler(scopeAccount))
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/api/v1/zones/z1", http.StatusOK},
+		{"/api/v1/zones/z2", http.StatusNotFound}, // not collected yet
+		{"/api/v1/zones/z3", http.StatusNotFound}, // not configured
+		{"/api/v1/accounts/z1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/zones/z1", nil))
+	var got apiTarget
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "z1" || got.Account != "default" || len(got.Datasets) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+	series := got.Datasets[0].Metrics[0].Series
+	if len(series) != 2 || series[1].Labels["host"] != "a b,c=d" || *series[1].Value != 2 || *series[1].Window != 2 {
+		t.Errorf("requests_total series %+v", series)
+	}
+}
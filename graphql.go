@@ -6,20 +6,26 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
-const graphqlEndpoint = "https://api.cloudflare.com/client/v4/graphql"
+const (
+	graphqlEndpoint = "https://api.cloudflare.com/client/v4/graphql"
+	zonesEndpoint   = "https://api.cloudflare.com/client/v4/zones/"
+)
 
 type GraphQLClient struct {
 	httpClient *http.Client
-	cfg        *Config
+	cred       *Credential
+	sched      *scheduler // request budget, nil for none
 }
 
-func NewGraphQLClient(cfg *Config) *GraphQLClient {
+func NewGraphQLClient(cred *Credential, sched *scheduler) *GraphQLClient {
 	return &GraphQLClient{
 		httpClient: &http.Client{Timeout: 15 * time.Second},
-		cfg:        cfg,
+		cred:       cred,
+		sched:      sched,
 	}
 }
 
@@ -31,11 +37,23 @@ type graphqlRequest struct {
 type graphqlResponse struct {
 	Data   json.RawMessage `json:"data"`
 	Errors []struct {
-		Message string `json:"message"`
+		Message    string `json:"message"`
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
 	} `json:"errors"`
 }
 
-func (c *GraphQLClient) query(q string, vars map[string]interface{}) (json.RawMessage, error) {
+func (c *GraphQLClient) query(q string, vars map[string]interface{}, priority int) (_ json.RawMessage, err error) {
+	if err := c.sched.wait(priority); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if isAuthFailure(err) {
+			c.cred.authFailures.Add(1)
+		}
+	}()
+
 	body, err := json.Marshal(graphqlRequest{Query: q, Variables: vars})
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
@@ -46,13 +64,7 @@ func (c *GraphQLClient) query(q string, vars map[string]interface{}) (json.RawMe
 		return nil, fmt.Errorf("create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-
-	if c.cfg.APIToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.cfg.APIToken)
-	} else {
-		req.Header.Set("X-Auth-Key", c.cfg.APIKey)
-		req.Header.Set("X-Auth-Email", c.cfg.APIEmail)
-	}
+	c.authorize(req)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -66,7 +78,7 @@ func (c *GraphQLClient) query(q string, vars map[string]interface{}) (json.RawMe
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respBody))
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	var gqlResp graphqlResponse
@@ -75,581 +87,283 @@ func (c *GraphQLClient) query(q string, vars map[string]interface{}) (json.RawMe
 	}
 
 	if len(gqlResp.Errors) > 0 {
-		return nil, fmt.Errorf("graphql error: %s", gqlResp.Errors[0].Message)
+		e := gqlResp.Errors[0]
+		return nil, &graphqlError{Message: e.Message, Code: e.Extensions.Code}
 	}
 
 	return gqlResp.Data, nil
 }
 
-// --- httpRequests1hGroups: pre-aggregated hourly HTTP analytics (works on all plans) ---
-
-type HTTPRequests1hResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []HTTPRequests1hGroup `json:"httpRequests1hGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
-}
-
-type HTTPRequests1hGroup struct {
-	Sum struct {
-		Requests          int64              `json:"requests"`
-		CachedRequests    int64              `json:"cachedRequests"`
-		EncryptedRequests int64              `json:"encryptedRequests"`
-		Bytes             int64              `json:"bytes"`
-		CachedBytes       int64              `json:"cachedBytes"`
-		EncryptedBytes    int64              `json:"encryptedBytes"`
-		Threats           int64              `json:"threats"`
-		PageViews         int64              `json:"pageViews"`
-		CountryMap        []CountryMapEntry  `json:"countryMap"`
-		ResponseStatusMap []StatusMapEntry   `json:"responseStatusMap"`
-		ContentTypeMap    []ContentMapEntry  `json:"contentTypeMap"`
-		BrowserMap        []BrowserMapEntry  `json:"browserMap"`
-	} `json:"sum"`
-	Uniq struct {
-		Uniques int64 `json:"uniques"`
-	} `json:"uniq"`
-}
-
-type CountryMapEntry struct {
-	Country  string `json:"clientCountryName"`
-	Requests int64  `json:"requests"`
-	Threats  int64  `json:"threats"`
-	Bytes    int64  `json:"bytes"`
-}
-
-type StatusMapEntry struct {
-	Status   int   `json:"edgeResponseStatus"`
-	Requests int64 `json:"requests"`
-}
-
-type ContentMapEntry struct {
-	ContentType string `json:"edgeResponseContentTypeName"`
-	Requests    int64  `json:"requests"`
-	Bytes       int64  `json:"bytes"`
-}
-
-type BrowserMapEntry struct {
-	Browser   string `json:"uaBrowserFamily"`
-	PageViews int64  `json:"pageViews"`
-}
-
-func (c *GraphQLClient) FetchHTTPRequests1h(zoneID string, since, until time.Time) ([]HTTPRequests1hGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				httpRequests1hGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 24
-					orderBy: [datetime_DESC]
-				) {
-					dimensions {
-						datetime
-					}
-					sum {
-						requests
-						cachedRequests
-						encryptedRequests
-						bytes
-						cachedBytes
-						encryptedBytes
-						threats
-						pageViews
-						countryMap {
-							clientCountryName
-							requests
-							threats
-							bytes
-						}
-						responseStatusMap {
-							edgeResponseStatus
-							requests
-						}
-						contentTypeMap {
-							edgeResponseContentTypeName
-							requests
-							bytes
-						}
-						browserMap {
-							uaBrowserFamily
-							pageViews
-						}
-					}
-					uniq {
-						uniques
-					}
-				}
-			}
-		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+func (c *GraphQLClient) authorize(req *http.Request) {
+	s := c.cred.secret.Load()
+	if s.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIToken)
+	} else {
+		req.Header.Set("X-Auth-Key", s.APIKey)
+		req.Header.Set("X-Auth-Email", s.APIEmail)
 	}
+}
 
-	data, err := c.query(q, vars)
+// ZoneName looks up the domain name of a zone via the REST API. It needs
+// the Zone:Read permission, which analytics-only tokens may lack.
+func (c *GraphQLClient) ZoneName(zoneID string) (string, error) {
+	req, err := http.NewRequest("GET", zonesEndpoint+zoneID, nil)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("create request: %w", err)
 	}
+	c.authorize(req)
 
-	var result HTTPRequests1hResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal http requests 1h: %w", err)
-	}
-
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
-	}
-	return result.Viewer.Zones[0].Groups, nil
-}
-
-// --- httpRequestsAdaptiveGroups: per-request dimensions (cache, protocol, SSL) ---
-
-type HTTPRequestsAdaptiveResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []HTTPRequestAdaptiveGroup `json:"httpRequestsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
-}
-
-type HTTPRequestAdaptiveGroup struct {
-	Count int `json:"count"`
-	Sum   struct {
-		EdgeResponseBytes int64 `json:"edgeResponseBytes"`
-		EdgeRequestBytes  int64 `json:"edgeRequestBytes"`
-	} `json:"sum"`
-	Dimensions struct {
-		CacheStatus               string `json:"cacheStatus"`
-		ClientRequestHTTPProtocol string `json:"clientRequestHTTPProtocol"`
-		ClientSSLProtocol         string `json:"clientSSLProtocol"`
-	} `json:"dimensions"`
-}
-
-func (c *GraphQLClient) FetchHTTPRequestsAdaptive(zoneID string, since, until time.Time) ([]HTTPRequestAdaptiveGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				httpRequestsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 5000
-					orderBy: [count_DESC]
-				) {
-					count
-					sum {
-						edgeResponseBytes
-						edgeRequestBytes
-					}
-					dimensions {
-						cacheStatus
-						clientRequestHTTPProtocol
-						clientSSLProtocol
-					}
-				}
-			}
-		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("http request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	data, err := c.query(q, vars)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("read response: %w", err)
 	}
-
-	var result HTTPRequestsAdaptiveResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal http requests adaptive: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpStatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
+	var zone struct {
+		Result struct {
+			Name string `json:"name"`
+		} `json:"result"`
 	}
-	return result.Viewer.Zones[0].Groups, nil
+	if err := json.Unmarshal(respBody, &zone); err != nil {
+		return "", fmt.Errorf("unmarshal response: %w", err)
+	}
+	return zone.Result.Name, nil
 }
 
-// --- httpRequestsAdaptiveGroups: security, device, browser, OS, origin status ---
+// --- datasets: queries generated from Dataset definitions ---
 
-type HTTPSecurityAdaptiveResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []HTTPSecurityAdaptiveGroup `json:"httpRequestsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
-}
-
-type HTTPSecurityAdaptiveGroup struct {
-	Count int `json:"count"`
-	Sum   struct {
-		EdgeResponseBytes int64 `json:"edgeResponseBytes"`
-		EdgeRequestBytes  int64 `json:"edgeRequestBytes"`
-	} `json:"sum"`
-	Dimensions struct {
-		SecurityAction       string `json:"securityAction"`
-		SecuritySource       string `json:"securitySource"`
-		ClientDeviceType     string `json:"clientDeviceType"`
-		UserAgentBrowser     string `json:"userAgentBrowser"`
-		UserAgentOS          string `json:"userAgentOS"`
-		OriginResponseStatus int    `json:"originResponseStatus"`
-	} `json:"dimensions"`
+// selection is a GraphQL selection set built from dotted field paths.
+type selection struct {
+	names    []string
+	children map[string]*selection
 }
 
-func (c *GraphQLClient) FetchHTTPSecurityAdaptive(zoneID string, since, until time.Time) ([]HTTPSecurityAdaptiveGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				httpRequestsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 5000
-					orderBy: [count_DESC]
-				) {
-					count
-					sum {
-						edgeResponseBytes
-						edgeRequestBytes
-					}
-					dimensions {
-						securityAction
-						securitySource
-						clientDeviceType
-						userAgentBrowser
-						userAgentOS
-						originResponseStatus
-					}
-				}
-			}
-		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+func (s *selection) add(path string) {
+	name, rest, nested := strings.Cut(path, ".")
+	if s.children == nil {
+		s.children = make(map[string]*selection)
 	}
-
-	data, err := c.query(q, vars)
-	if err != nil {
-		return nil, err
-	}
-
-	var result HTTPSecurityAdaptiveResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal http security adaptive: %w", err)
+	child, ok := s.children[name]
+	if !ok {
+		child = &selection{}
+		s.children[name] = child
+		s.names = append(s.names, name)
 	}
-
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
+	if nested {
+		child.add(rest)
 	}
-	return result.Viewer.Zones[0].Groups, nil
-}
-
-// --- httpRequestsAdaptiveGroups: by HTTP status code ---
-
-type HTTPStatusResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []HTTPStatusGroup `json:"httpRequestsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
 }
 
-type HTTPStatusGroup struct {
-	Count      int `json:"count"`
-	Dimensions struct {
-		EdgeResponseStatus int `json:"edgeResponseStatus"`
-	} `json:"dimensions"`
-}
-
-func (c *GraphQLClient) FetchHTTPRequestsByStatus(zoneID string, since, until time.Time) ([]HTTPStatusGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				httpRequestsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 1000
-					orderBy: [count_DESC]
-				) {
-					count
-					dimensions {
-						edgeResponseStatus
-					}
-				}
-			}
+func (s *selection) write(b *strings.Builder, indent string) {
+	for _, name := range s.names {
+		child := s.children[name]
+		if len(child.names) == 0 {
+			fmt.Fprintf(b, "%s%s\n", indent, name)
+			continue
 		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+		fmt.Fprintf(b, "%s%s {\n", indent, name)
+		child.write(b, indent+"\t")
+		fmt.Fprintf(b, "%s}\n", indent)
 	}
-
-	data, err := c.query(q, vars)
-	if err != nil {
-		return nil, err
-	}
-
-	var result HTTPStatusResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal http status: %w", err)
-	}
-
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
-	}
-	return result.Viewer.Zones[0].Groups, nil
 }
 
-// --- httpRequestsAdaptiveGroups: by client country ---
-
-type HTTPCountryResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []HTTPCountryGroup `json:"httpRequestsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
+// viewerField is the viewer collection a dataset of the given scope lives in.
+func (ds *Dataset) viewerField() string {
+	if ds.Scope == scopeAccount {
+		return "accounts"
+	}
+	return "zones"
 }
 
-type HTTPCountryGroup struct {
-	Count int `json:"count"`
-	Sum   struct {
-		EdgeResponseBytes int64 `json:"edgeResponseBytes"`
-	} `json:"sum"`
-	Dimensions struct {
-		ClientCountryName string `json:"clientCountryName"`
-	} `json:"dimensions"`
+// tagVariable is the query variable holding the zone or account ID.
+func (ds *Dataset) tagVariable() string {
+	if ds.Scope == scopeAccount {
+		return "accountID"
+	}
+	return "zoneID"
 }
 
-func (c *GraphQLClient) FetchHTTPRequestsByCountry(zoneID string, since, until time.Time) ([]HTTPCountryGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				httpRequestsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 5000
-					orderBy: [count_DESC]
-				) {
-					count
-					sum {
-						edgeResponseBytes
-					}
-					dimensions {
-						clientCountryName
-					}
-				}
-			}
-		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+// query renders the GraphQL query for a dataset.
+func (ds *Dataset) query() string {
+	sel := &selection{}
+	for _, f := range ds.fields() {
+		sel.add(f)
 	}
 
-	data, err := c.query(q, vars)
-	if err != nil {
-		return nil, err
+	tagFilter := "zoneTag"
+	if ds.Scope == scopeAccount {
+		tagFilter = "accountTag"
 	}
 
-	var result HTTPCountryResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal http country: %w", err)
+	var b strings.Builder
+	timeType := "Time"
+	if ds.Window == windowDaily {
+		timeType = "Date"
 	}
-
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
+	fmt.Fprintf(&b, "query ($%s: String!, $since: %s!, $until: %s!) {\n", ds.tagVariable(), timeType, timeType)
+	b.WriteString("\tviewer {\n")
+	fmt.Fprintf(&b, "\t\t%s(filter: {%s: $%s}) {\n", ds.viewerField(), tagFilter, ds.tagVariable())
+	fmt.Fprintf(&b, "\t\t\t%s(\n", ds.Node)
+	fmt.Fprintf(&b, "\t\t\t\tfilter: {%[1]s_geq: $since, %[1]s_lt: $until}\n", ds.timeField())
+	fmt.Fprintf(&b, "\t\t\t\tlimit: %d\n", ds.Limit)
+	if ds.OrderBy != "" {
+		fmt.Fprintf(&b, "\t\t\t\torderBy: [%s]\n", ds.OrderBy)
 	}
-	return result.Viewer.Zones[0].Groups, nil
-}
-
-// --- dnsAnalyticsAdaptiveGroups: DNS query analytics ---
-
-type DNSAnalyticsResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []DNSAnalyticsGroup `json:"dnsAnalyticsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
+	b.WriteString("\t\t\t) {\n")
+	sel.write(&b, "\t\t\t\t")
+	b.WriteString("\t\t\t}\n\t\t}\n\t}\n}")
+	return b.String()
 }
 
-type DNSAnalyticsGroup struct {
-	Count      int `json:"count"`
-	Dimensions struct {
-		QueryName    string `json:"queryName"`
-		QueryType    string `json:"queryType"`
-		ResponseCode string `json:"responseCode"`
-	} `json:"dimensions"`
+// datasetResult is the response shape shared by all datasets:
+// viewer.<zones|accounts>[0].<node>[] groups.
+type datasetResult struct {
+	Viewer map[string][]map[string][]map[string]interface{} `json:"viewer"`
 }
 
-func (c *GraphQLClient) FetchDNSAnalytics(zoneID string, since, until time.Time) ([]DNSAnalyticsGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				dnsAnalyticsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 5000
-					orderBy: [count_DESC]
-				) {
-					count
-					dimensions {
-						queryName
-						queryType
-						responseCode
-					}
-				}
+// FetchDataset queries a dataset for one zone or account and returns its raw
+// groups. A full page of an hourly or daily dataset is continued with the
+// buckets up to its oldest one, which may have been cut off and is fetched
+// again.
+func (c *GraphQLClient) FetchDataset(ds *Dataset, tag string, since, until time.Time) ([]map[string]interface{}, error) {
+	var groups []map[string]interface{}
+	for {
+		page, err := c.fetchPage(ds, tag, since, until)
+		if err != nil || ds.bucket() == 0 || len(page) < ds.Limit {
+			return append(groups, page...), err
+		}
+		oldest, ok := until, false
+		for _, g := range page {
+			if bucket, found := ds.groupBucket(g); found && bucket.Before(oldest) {
+				oldest, ok = bucket, true
 			}
 		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
-	}
-
-	data, err := c.query(q, vars)
-	if err != nil {
-		return nil, err
-	}
-
-	var result DNSAnalyticsResult
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal dns analytics: %w", err)
-	}
-
-	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
+		if !ok {
+			// Without buckets (custom query) there is nothing to continue from
+			return append(groups, page...), nil
+		}
+		next := oldest.Add(ds.bucket())
+		if !next.Before(until) {
+			return nil, fmt.Errorf("%s: more than %d groups in bucket %s, raise the limit",
+				ds.Name, ds.Limit, oldest.Format(ds.timeFormat()))
+		}
+		for _, g := range page {
+			if bucket, _ := ds.groupBucket(g); !bucket.Before(next) {
+				groups = append(groups, g)
+			}
+		}
+		until = next
 	}
-	return result.Viewer.Zones[0].Groups, nil
 }
 
-// --- firewallEventsAdaptiveGroups: WAF/Firewall (requires Pro+ plan) ---
-
-type FirewallEventsResult struct {
-	Viewer struct {
-		Zones []struct {
-			Groups []FirewallEventGroup `json:"firewallEventsAdaptiveGroups"`
-		} `json:"zones"`
-	} `json:"viewer"`
-}
-
-type FirewallEventGroup struct {
-	Count      int `json:"count"`
-	Dimensions struct {
-		Action            string `json:"action"`
-		Source            string `json:"source"`
-		ClientCountryName string `json:"clientCountryName"`
-	} `json:"dimensions"`
-}
+// fetchPage runs one query of a dataset.
+func (c *GraphQLClient) fetchPage(ds *Dataset, tag string, since, until time.Time) ([]map[string]interface{}, error) {
+	vars := map[string]interface{}{
+		ds.tagVariable(): tag,
+		"since":          since.Format(ds.timeFormat()),
+		"until":          until.Format(ds.timeFormat()),
+	}
 
-func (c *GraphQLClient) FetchFirewallEvents(zoneID string, since, until time.Time) ([]FirewallEventGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
-		viewer {
-			zones(filter: {zoneTag: $zoneID}) {
-				firewallEventsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 5000
-					orderBy: [count_DESC]
-				) {
-					count
-					dimensions {
-						action
-						source
-						clientCountryName
-					}
-				}
-			}
+	if ds.Query != "" {
+		data, err := c.query(ds.Query, vars, datasetPriority(ds))
+		if err != nil {
+			return nil, err
 		}
-	}`
-
-	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+		var result interface{}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("unmarshal %s: %w", ds.Name, err)
+		}
+		return objects(evalPath(result, ds.Path)), nil
 	}
 
-	data, err := c.query(q, vars)
+	data, err := c.query(ds.query(), vars, datasetPriority(ds))
 	if err != nil {
 		return nil, err
 	}
 
-	var result FirewallEventsResult
+	var result datasetResult
 	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal firewall events: %w", err)
+		return nil, fmt.Errorf("unmarshal %s: %w", ds.Name, err)
 	}
 
-	if len(result.Viewer.Zones) == 0 {
+	targets := result.Viewer[ds.viewerField()]
+	if len(targets) == 0 {
 		return nil, nil
 	}
-	return result.Viewer.Zones[0].Groups, nil
+	return targets[0][ds.Node], nil
 }
 
-// --- healthCheckEventsAdaptiveGroups: Health checks (requires Pro+ plan) ---
+// --- httpRequestsAdaptive: sampled raw requests (Ray IDs for exemplars) ---
+
+// exemplarMinStatus is the lowest edge status code sampled for exemplars.
+const exemplarMinStatus = 400
 
-type HealthCheckResult struct {
+type RaySamplesResult struct {
 	Viewer struct {
 		Zones []struct {
-			Groups []HealthCheckGroup `json:"healthCheckEventsAdaptiveGroups"`
+			Requests []RaySample `json:"httpRequestsAdaptive"`
 		} `json:"zones"`
 	} `json:"viewer"`
 }
 
-type HealthCheckGroup struct {
-	Count      int `json:"count"`
-	Dimensions struct {
-		HealthStatus    string `json:"healthStatus"`
-		OriginIP        string `json:"originIP"`
-		HealthCheckName string `json:"healthCheckName"`
-		Region          string `json:"region"`
-	} `json:"dimensions"`
+type RaySample struct {
+	RayName            string    `json:"rayName"`
+	EdgeResponseStatus int       `json:"edgeResponseStatus"`
+	Datetime           time.Time `json:"datetime"`
 }
 
-func (c *GraphQLClient) FetchHealthChecks(zoneID string, since, until time.Time) ([]HealthCheckGroup, error) {
-	q := `query ($zoneID: String!, $since: Time!, $until: Time!) {
+// FetchRaySamples returns the newest sampled request per error status code.
+func (c *GraphQLClient) FetchRaySamples(zoneID string, since, until time.Time) (map[int]RaySample, error) {
+	q := `query ($zoneID: String!, $since: Time!, $until: Time!, $minStatus: Int!) {
 		viewer {
 			zones(filter: {zoneTag: $zoneID}) {
-				healthCheckEventsAdaptiveGroups(
-					filter: {datetime_geq: $since, datetime_lt: $until}
-					limit: 1000
-					orderBy: [count_DESC]
+				httpRequestsAdaptive(
+					filter: {datetime_geq: $since, datetime_lt: $until, edgeResponseStatus_geq: $minStatus}
+					limit: 100
+					orderBy: [datetime_DESC]
 				) {
-					count
-					dimensions {
-						healthStatus
-						originIP
-						healthCheckName
-						region
-					}
+					rayName
+					edgeResponseStatus
+					datetime
 				}
 			}
 		}
 	}`
 
 	vars := map[string]interface{}{
-		"zoneID": zoneID,
-		"since":  since.Format(time.RFC3339),
-		"until":  until.Format(time.RFC3339),
+		"zoneID":    zoneID,
+		"since":     since.Format(time.RFC3339),
+		"until":     until.Format(time.RFC3339),
+		"minStatus": exemplarMinStatus,
 	}
 
-	data, err := c.query(q, vars)
+	data, err := c.query(q, vars, priorityLow)
 	if err != nil {
 		return nil, err
 	}
 
-	var result HealthCheckResult
+	var result RaySamplesResult
 	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("unmarshal health checks: %w", err)
+		return nil, fmt.Errorf("unmarshal ray samples: %w", err)
 	}
 
+	samples := make(map[int]RaySample)
 	if len(result.Viewer.Zones) == 0 {
-		return nil, nil
+		return samples, nil
+	}
+	for _, r := range result.Viewer.Zones[0].Requests {
+		// Ordered newest first: keep the first sample per status
+		if _, ok := samples[r.EdgeResponseStatus]; !ok && r.RayName != "" {
+			samples[r.EdgeResponseStatus] = r
+		}
 	}
-	return result.Viewer.Zones[0].Groups, nil
+	return samples, nil
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// roundTripFunc serves requests with a handler instead of the network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// testGraphQLClient returns a client whose queries are answered by serve,
+// called with the query variables. It returns the response data or a
+// GraphQL error message.
+func testGraphQLClient(serve func(vars map[string]interface{}) (interface{}, string)) *GraphQLClient {
+	return testGraphQLErrorClient(func(vars map[string]interface{}) (interface{}, map[string]interface{}) {
+		data, errMsg := serve(vars)
+		if errMsg != "" {
+			return nil, map[string]interface{}{"message": errMsg}
+		}
+		return data, nil
+	})
+}
+
+// testGraphQLErrorClient is testGraphQLClient with serve returning the
+// GraphQL error object, e.g. with extensions.
+func testGraphQLErrorClient(serve func(vars map[string]interface{}) (interface{}, map[string]interface{})) *GraphQLClient {
+	cred := &Credential{Name: "default"}
+	cred.secret.Store(&credentialSecret{APIToken: "token"})
+	c := NewGraphQLClient(cred, nil)
+	c.httpClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		if req.Method != http.MethodPost {
+			rec.WriteHeader(http.StatusNotFound)
+			return rec.Result(), nil
+		}
+		var q graphqlRequest
+		if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+			return nil, err
+		}
+		resp := make(map[string]interface{})
+		data, gqlErr := serve(q.Variables)
+		if gqlErr != nil {
+			resp["errors"] = []interface{}{gqlErr}
+		} else {
+			resp["data"] = data
+		}
+		body, _ := json.Marshal(resp)
+		rec.Write(body)
+		return rec.Result(), nil
+	})
+	return c
+}
+
+// zoneData is the response data of a zone dataset query.
+func zoneData(node string, groups []map[string]interface{}) interface{} {
+	return map[string]interface{}{"viewer": map[string]interface{}{"zones": []interface{}{
+		map[string]interface{}{node: groups},
+	}}}
+}
+
+func hourlyDataset(t *testing.T, limit int) *Dataset {
+	t.Helper()
+	return testDataset(t, &Dataset{
+		Name: "hourly", Node: "httpRequests1hGroups", Window: windowHourly, Limit: limit,
+		Metrics: []DatasetMetric{{Name: "requests", Field: "sum.requests"}},
+	})
+}
+
+func TestFetchDatasetPagination(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		hours     int // with data, from start
+		perHour   int // groups per hour
+		limit     int
+		wantPages int
+		err       bool
+	}{
+		{"one page", 2, 1, 3, 1, false},
+		{"exactly full", 3, 1, 3, 2, false},
+		{"several pages", 10, 1, 3, 5, false},
+		{"several groups per hour", 6, 2, 5, 3, false},
+		{"hour exceeds limit", 2, 4, 3, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := hourlyDataset(t, tt.limit)
+			pages := 0
+			c := testGraphQLClient(func(vars map[string]interface{}) (interface{}, string) {
+				pages++
+				since, _ := time.Parse(time.RFC3339, vars["since"].(string))
+				until, _ := time.Parse(time.RFC3339, vars["until"].(string))
+				var groups []map[string]interface{}
+				for h := until.Add(-time.Hour); !h.Before(since) && len(groups) < tt.limit; h = h.Add(-time.Hour) {
+					for i := 0; i < tt.perHour && len(groups) < tt.limit; i++ {
+						groups = append(groups, map[string]interface{}{
+							"sum":        map[string]interface{}{"requests": 1.0},
+							"dimensions": map[string]interface{}{"datetime": h.Format(time.RFC3339)},
+						})
+					}
+				}
+				return zoneData(ds.Node, groups), ""
+			})
+
+			groups, err := c.FetchDataset(ds, "z1", start, start.Add(time.Duration(tt.hours)*time.Hour))
+			if (err != nil) != tt.err {
+				t.Fatalf("FetchDataset error = %v, want %v", err, tt.err)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("%d pages, want %d", pages, tt.wantPages)
+			}
+			if tt.err {
+				return
+			}
+			seen := make(map[string]int)
+			for _, g := range groups {
+				bucket, ok := ds.groupBucket(g)
+				if !ok {
+					t.Fatalf("group without hour: %v", g)
+				}
+				seen[bucket.Format(time.RFC3339)]++
+			}
+			if len(seen) != tt.hours {
+				t.Errorf("got %d hours, want %d", len(seen), tt.hours)
+			}
+			for hour, n := range seen {
+				if n != tt.perHour {
+					t.Errorf("hour %s: %d groups, want %d", hour, n, tt.perHour)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphQLErrorCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       map[string]interface{}
+		wantCode  string
+		wantClass string
+	}{
+		{"with code", map[string]interface{}{
+			"message":    "zone 'x' does not have access to the path",
+			"path":       []interface{}{"viewer", "zones", 0, "httpRequestsAdaptiveGroups"},
+			"extensions": map[string]interface{}{"code": "authz", "timestamp": "2026-01-01T10:00:00Z"},
+		}, "authz", "unavailable"},
+		{"without extensions", map[string]interface{}{"message": "zone 'x' does not have access to the path"}, "", "unavailable"},
+		{"other code", map[string]interface{}{
+			"message": "internal error", "extensions": map[string]interface{}{"code": "internal"},
+		}, "internal", "graphql"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := hourlyDataset(t, 10)
+			c := testGraphQLErrorClient(func(map[string]interface{}) (interface{}, map[string]interface{}) {
+				return nil, tt.err
+			})
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			_, err := c.FetchDataset(ds, "z1", start, start.Add(time.Hour))
+			var gqlErr *graphqlError
+			if !errors.As(err, &gqlErr) {
+				t.Fatalf("error %v, want a GraphQL error", err)
+			}
+			if gqlErr.Code != tt.wantCode {
+				t.Errorf("code %q, want %q", gqlErr.Code, tt.wantCode)
+			}
+			if class := errorClass(err); class != tt.wantClass {
+				t.Errorf("class %q, want %q", class, tt.wantClass)
+			}
+		})
+	}
+}
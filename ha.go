@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	haBackendFile       = "file"
+	haBackendKubernetes = "kubernetes"
+)
+
+// lease is the leadership record shared by the replicas. Address is the
+// leader's base URL, which followers proxy to and sync state from.
+type lease struct {
+	Holder    string        `json:"holder"`
+	Address   string        `json:"address"`
+	RenewTime time.Time     `json:"renew_time"`
+	Duration  time.Duration `json:"duration"`
+}
+
+func (l lease) expired(now time.Time) bool {
+	return l.Holder == "" || now.After(l.RenewTime.Add(l.Duration))
+}
+
+// leaseBackend stores the lease.
+type leaseBackend interface {
+	// acquire takes want if the lease is free, expired or already held by
+	// want.Holder, and returns the lease as it stands afterwards.
+	acquire(ctx context.Context, want lease) (lease, error)
+	// release frees the lease if it is held by holder.
+	release(ctx context.Context, holder string) error
+}
+
+// elector runs leader election between replicas. Only the leader collects;
+// followers proxy the data endpoints to it and keep a copy of its state to
+// take over with, so counters continue across failover.
+type elector struct {
+	backend  leaseBackend
+	identity string
+	address  string
+	duration time.Duration
+	reloader *reloader
+	client   *http.Client
+	// restored, if set, is called after taking over the previous leader's
+	// state
+	restored func()
+
+	leading   atomic.Bool
+	mu        sync.Mutex
+	lastRenew time.Time // of the lease
+	current   lease     // as last observed
+	synced    []byte    // leader's checkpoint, restored on takeover
+
+	leaderDesc *prometheus.Desc
+}
+
+func newElector(cfg *Config, r *reloader) (*elector, error) {
+	var backend leaseBackend
+	switch cfg.HABackend {
+	case haBackendFile:
+		backend = &fileLease{path: cfg.HALeaseFile}
+	case haBackendKubernetes:
+		k, err := newKubernetesLease(cfg.HALeaseName, cfg.HALeaseNamespace)
+		if err != nil {
+			return nil, err
+		}
+		backend = k
+	default:
+		return nil, fmt.Errorf("unknown HA backend %q", cfg.HABackend)
+	}
+	// The replicas share the web config, requests to the leader need the
+	// matching TLS settings and credentials
+	client := &http.Client{Timeout: 30 * time.Second}
+	if cfg.HAClientConfig != "" {
+		hc, err := loadHTTPClientConfig(cfg.HAClientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("HA_CLIENT_CONFIG: %w", err)
+		}
+		if client.Transport, err = config.NewRoundTripperFromConfig(*hc, "cloudflare-exporter"); err != nil {
+			return nil, fmt.Errorf("HA_CLIENT_CONFIG: %w", err)
+		}
+	}
+	return &elector{
+		backend:  backend,
+		identity: cfg.HAIdentity,
+		address:  cfg.HAAdvertiseURL,
+		duration: time.Duration(cfg.HALeaseDuration) * time.Second,
+		reloader: r,
+		client:   client,
+		leaderDesc: prometheus.NewDesc(
+			"cloudflare_exporter_ha_leader",
+			"Whether this replica is the leader collecting from Cloudflare (1=yes, 0=no)",
+			[]string{"identity"}, nil,
+		),
+	}, nil
+}
+
+// loadHTTPClientConfig reads a Prometheus HTTP client config file, e.g.
+// with tls_config and basic_auth. Relative paths in it are resolved
+// against its directory.
+func loadHTTPClientConfig(path string) (*config.HTTPClientConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hc, err := config.LoadHTTPConfig(string(data))
+	if err != nil {
+		return nil, err
+	}
+	hc.SetDirectory(filepath.Dir(path))
+	return hc, nil
+}
+
+// isLeader reports whether this replica holds the lease and renewed it
+// within the renew deadline.
+func (e *elector) isLeader() bool {
+	if !e.leading.Load() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Since(e.lastRenew) < e.renewDeadline()
+}
+
+// renewDeadline is how long the leader keeps collecting without renewing
+// the lease. It is shorter than the lease, as in client-go's leader
+// election, so the leader stops before another replica can take over.
+func (e *elector) renewDeadline() time.Duration {
+	return e.duration * 2 / 3
+}
+
+// run renews or tries to acquire the lease every third of its duration and
+// releases it when ctx is done, so a follower takes over right away.
+func (e *elector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	e.mu.Lock()
+	e.lastRenew = time.Now()
+	e.mu.Unlock()
+	for {
+		e.renew(ctx)
+		select {
+		case <-ctx.Done():
+			// Keep leading until exit, the final state is saved by the leader
+			if e.isLeader() {
+				if err := e.backend.release(context.WithoutCancel(ctx), e.identity); err != nil {
+					slog.Warn("ha: lease release failed", errAttrs(err)...)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renew renews or tries to acquire the lease once, taking over or stepping
+// down as it turns out, and syncs the leader's state while following.
+func (e *elector) renew(ctx context.Context) {
+	now := time.Now()
+	l, err := e.backend.acquire(ctx, lease{
+		Holder:    e.identity,
+		Address:   e.address,
+		RenewTime: now,
+		Duration:  e.duration,
+	})
+	switch {
+	case err != nil:
+		slog.Warn("ha: lease update failed", errAttrs(err)...)
+		// isLeader turned false at the renew deadline already
+		if e.leading.Load() && !e.isLeader() {
+			e.stepDown()
+		}
+	case l.Holder == e.identity:
+		// The others count the lease from the renew time sent
+		e.mu.Lock()
+		e.lastRenew = now
+		e.mu.Unlock()
+		if !e.leading.Load() {
+			e.takeOver()
+		}
+	default:
+		if e.leading.Load() {
+			e.stepDown()
+		}
+		e.mu.Lock()
+		changed := e.current.Holder != l.Holder
+		e.current = l
+		e.mu.Unlock()
+		if changed {
+			slog.Info("ha: following", "leader", l.Holder, "address", l.Address)
+		}
+		e.sync()
+	}
+}
+
+// takeOver restores the checkpoint last synced from the previous leader,
+// if any, and starts collecting.
+func (e *elector) takeOver() {
+	e.mu.Lock()
+	synced := e.synced
+	e.synced = nil
+	e.current = lease{Holder: e.identity, Address: e.address}
+	e.mu.Unlock()
+	if synced != nil {
+		if err := e.reloader.current().restoreState(synced); err != nil {
+			slog.Error("ha: restoring leader state failed", "error", err)
+		} else if e.restored != nil {
+			e.restored()
+		}
+	}
+	e.leading.Store(true)
+	slog.Info("ha: elected leader", "identity", e.identity, "restored_state", synced != nil)
+}
+
+// stepDown stops collecting. The leader is unknown until the lease is read
+// again, this replica's own address is no place to proxy to.
+func (e *elector) stepDown() {
+	e.mu.Lock()
+	e.current = lease{}
+	e.mu.Unlock()
+	e.leading.Store(false)
+	slog.Warn("ha: lost leadership", "identity", e.identity)
+}
+
+// sync fetches the leader's checkpoint.
+func (e *elector) sync() {
+	addr := e.leaderAddress()
+	if addr == "" {
+		return
+	}
+	resp, err := e.client.Get(addr + "/-/state")
+	if err != nil {
+		slog.Warn("ha: state sync failed", errAttrs(err)...)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode/100 != 2 {
+		err = &httpStatusError{StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	if err != nil {
+		slog.Warn("ha: state sync failed", errAttrs(err)...)
+		return
+	}
+	e.mu.Lock()
+	e.synced = data
+	e.mu.Unlock()
+}
+
+// leaderAddress returns the current leader's base URL, empty if unknown.
+func (e *elector) leaderAddress() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current.Address
+}
+
+// route serves h on the leader and proxies to the leader on followers,
+// with the TLS settings of the elector's client. Credentials of the
+// proxied request are passed on, the client's are added if it has none.
+func (e *elector) route(h http.Handler) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Transport: e.client.Transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// Validated in route before proxying
+			target, _ := url.Parse(e.leaderAddress())
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("ha: proxy to leader failed", errAttrs(err)...)
+			http.Error(w, "leader unreachable", http.StatusBadGateway)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.isLeader() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Past the renew deadline this replica may still be recorded as
+		// the leader, it mustn't proxy to itself
+		if addr := e.leaderAddress(); addr == "" || addr == e.address {
+			http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// exporterMetricPrefix starts the names of the exporter's own metrics, as
+// opposed to the series derived from Cloudflare data.
+const exporterMetricPrefix = "cloudflare_exporter_"
+
+// metricsHandler serves /metrics: gatherer on the leader; on followers their
+// own exporter metrics from self, e.g. cloudflare_exporter_ha_leader, and
+// the Cloudflare-derived series of the leader.
+func (e *elector) metricsHandler(gatherer, self prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	leading := promhttp.HandlerFor(gatherer, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.isLeader() {
+			leading.ServeHTTP(w, r)
+			return
+		}
+		gatherers := prometheus.Gatherers{self}
+		if addr := e.leaderAddress(); addr != "" && addr != e.address {
+			gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return e.leaderMetrics(r, addr)
+			}))
+		}
+		promhttp.HandlerFor(gatherers, opts).ServeHTTP(w, r)
+	})
+}
+
+// leaderMetrics fetches the Cloudflare-derived series from the leader's
+// /metrics for the follower's request r, passing on its credentials like
+// route does.
+func (e *elector) leaderMetrics(r *http.Request, addr string) ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, addr+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		slog.Warn("ha: proxy to leader failed", errAttrs(err)...)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		err := &httpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		slog.Warn("ha: proxy to leader failed", errAttrs(err)...)
+		return nil, err
+	}
+	var mfs []*dto.MetricFamily
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return mfs, nil
+		} else if err != nil {
+			return mfs, err
+		}
+		if !strings.HasPrefix(mf.GetName(), exporterMetricPrefix) {
+			mfs = append(mfs, mf)
+		}
+	}
+}
+
+// stateHandler serves GET /-/state, this replica's checkpoint.
+func (e *elector) stateHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := e.reloader.current().marshalState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (e *elector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.leaderDesc
+}
+
+func (e *elector) Collect(ch chan<- prometheus.Metric) {
+	leading := 0.0
+	if e.isLeader() {
+		leading = 1
+	}
+	ch <- prometheus.MustNewConstMetric(e.leaderDesc, prometheus.GaugeValue, leading, e.identity)
+}
+
+// --- file backend ---
+
+// fileLease stores the lease as JSON in a file locked with flock, e.g. on a
+// volume shared by replicas on one host. Meant for testing and single-host
+// setups.
+type fileLease struct {
+	path string
+}
+
+// update applies fn to the stored lease while holding the file lock.
+func (f *fileLease) update(fn func(cur lease) (lease, bool)) (lease, error) {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return lease{}, err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return lease{}, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	var cur lease
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return lease{}, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &cur); err != nil {
+			return lease{}, fmt.Errorf("parse %s: %w", f.path, err)
+		}
+	}
+	next, write := fn(cur)
+	if !write {
+		return cur, nil
+	}
+	if data, err = json.Marshal(next); err != nil {
+		return lease{}, err
+	}
+	if err := file.Truncate(0); err != nil {
+		return lease{}, err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return lease{}, err
+	}
+	return next, nil
+}
+
+func (f *fileLease) acquire(_ context.Context, want lease) (lease, error) {
+	return f.update(func(cur lease) (lease, bool) {
+		if cur.Holder == want.Holder || cur.expired(want.RenewTime) {
+			return want, true
+		}
+		return cur, false
+	})
+}
+
+func (f *fileLease) release(_ context.Context, holder string) error {
+	_, err := f.update(func(cur lease) (lease, bool) {
+		return lease{}, cur.Holder == holder
+	})
+	return err
+}
+
+// --- Kubernetes backend ---
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// leaseAddressAnnotation carries the leader's address on the Lease.
+	leaseAddressAnnotation = "cloudflare-exporter/address"
+	microTimeFormat        = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// kubernetesLease stores the lease in a coordination.k8s.io/v1 Lease via
+// the API server's REST API, authenticated with the pod's service account.
+type kubernetesLease struct {
+	name, namespace string
+	url             string // of the Lease collection
+	tokenFile       string // service account token
+	client          *http.Client
+}
+
+// k8sLease is the subset of the Lease object the exporter uses.
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+func (k *k8sLease) lease() lease {
+	renew, _ := time.Parse(microTimeFormat, k.Spec.RenewTime)
+	return lease{
+		Holder:    k.Spec.HolderIdentity,
+		Address:   k.Metadata.Annotations[leaseAddressAnnotation],
+		RenewTime: renew,
+		Duration:  time.Duration(k.Spec.LeaseDurationSeconds) * time.Second,
+	}
+}
+
+func newKubernetesLease(name, namespace string) (*kubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kubernetes HA backend requires running in a cluster (KUBERNETES_SERVICE_HOST unset)")
+	}
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("HA_LEASE_NAMESPACE unset and %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &kubernetesLease{
+		name:      name,
+		namespace: namespace,
+		url: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+			net.JoinHostPort(host, port), namespace),
+		tokenFile: serviceAccountDir + "/token",
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+var errLeaseConflict = errors.New("lease was modified concurrently")
+
+// do sends a request to the API server. The service account token is read
+// on every request, the kubelet rotates it. A GET of a Lease that doesn't
+// exist returns nil; for other methods a missing Lease or collection, e.g.
+// of a deleted namespace, is an error.
+func (k *kubernetesLease) do(ctx context.Context, method, url string, body any) (*k8sLease, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return nil, nil
+	case resp.StatusCode == http.StatusConflict:
+		return nil, errLeaseConflict
+	case resp.StatusCode/100 != 2:
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	var l k8sLease
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (k *kubernetesLease) acquire(ctx context.Context, want lease) (lease, error) {
+	cur, err := k.do(ctx, http.MethodGet, k.url+"/"+k.name, nil)
+	if err != nil {
+		return lease{}, err
+	}
+	now := want.RenewTime.UTC().Format(microTimeFormat)
+	if cur == nil {
+		l := &k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		l.Metadata.Name, l.Metadata.Namespace = k.name, k.namespace
+		l.Metadata.Annotations = map[string]string{leaseAddressAnnotation: want.Address}
+		l.Spec.HolderIdentity = want.Holder
+		l.Spec.LeaseDurationSeconds = int(want.Duration / time.Second)
+		l.Spec.AcquireTime, l.Spec.RenewTime = now, now
+		created, err := k.do(ctx, http.MethodPost, k.url, l)
+		if errors.Is(err, errLeaseConflict) {
+			// Created by another replica first
+			return lease{}, nil
+		}
+		if err != nil {
+			return lease{}, err
+		}
+		return created.lease(), nil
+	}
+
+	held := cur.lease()
+	if held.Holder != want.Holder && !held.expired(want.RenewTime) {
+		return held, nil
+	}
+	spec := map[string]any{
+		"holderIdentity":       want.Holder,
+		"leaseDurationSeconds": int(want.Duration / time.Second),
+		"renewTime":            now,
+	}
+	if held.Holder != want.Holder {
+		spec["acquireTime"] = now
+		spec["leaseTransitions"] = cur.Spec.LeaseTransitions + 1
+	}
+	updated, err := k.patch(ctx, cur, spec, want.Address)
+	if errors.Is(err, errLeaseConflict) {
+		// Another replica won the update, retry next round
+		return held, nil
+	}
+	if err != nil {
+		return lease{}, err
+	}
+	return updated.lease(), nil
+}
+
+func (k *kubernetesLease) release(ctx context.Context, holder string) error {
+	cur, err := k.do(ctx, http.MethodGet, k.url+"/"+k.name, nil)
+	if err != nil || cur == nil || cur.Spec.HolderIdentity != holder {
+		return err
+	}
+	_, err = k.patch(ctx, cur, map[string]any{"holderIdentity": nil, "leaseDurationSeconds": 1}, "")
+	return err
+}
+
+// patch updates the Lease read as cur with a JSON merge patch of its spec
+// and address annotation, leaving labels, other annotations and owner
+// references alone. The resource version makes the update fail with a
+// conflict if the Lease changed since it was read.
+func (k *kubernetesLease) patch(ctx context.Context, cur *k8sLease, spec map[string]any, address string) (*k8sLease, error) {
+	metadata := map[string]any{"resourceVersion": cur.Metadata.ResourceVersion}
+	if address != "" {
+		metadata["annotations"] = map[string]string{leaseAddressAnnotation: address}
+	}
+	return k.do(ctx, http.MethodPatch, k.url+"/"+k.name, map[string]any{"metadata": metadata, "spec": spec})
+}
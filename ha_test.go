@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestFileLease(t *testing.T) {
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	f := &fileLease{path: filepath.Join(t.TempDir(), "lease")}
+	steps := []struct {
+		name    string
+		release string // released by before acquiring
+		holder  string
+		at      time.Duration // after start
+		want    string
+	}{
+		{"free", "", "a", 0, "a"},
+		{"held", "", "b", 10 * time.Second, "a"},
+		{"renewed", "", "a", 10 * time.Second, "a"},
+		{"held after renewal", "", "b", 20 * time.Second, "a"},
+		{"expired", "", "b", 30 * time.Second, "b"},
+		{"released by another", "a", "c", 31 * time.Second, "b"},
+		{"released", "b", "c", 32 * time.Second, "c"},
+	}
+	for _, tt := range steps {
+		if tt.release != "" {
+			if err := f.release(context.Background(), tt.release); err != nil {
+				t.Fatalf("%s: release: %v", tt.name, err)
+			}
+		}
+		l, err := f.acquire(context.Background(), lease{
+			Holder: tt.holder, Address: "http://" + tt.holder, RenewTime: start.Add(tt.at), Duration: 15 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("%s: acquire: %v", tt.name, err)
+		}
+		if l.Holder != tt.want || l.Address != "http://"+tt.want {
+			t.Errorf("%s: lease held by %q at %q, want %q", tt.name, l.Holder, l.Address, tt.want)
+		}
+	}
+
+	if err := os.WriteFile(f.path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.acquire(context.Background(), lease{Holder: "a", RenewTime: start}); err == nil {
+		t.Error("acquire of a corrupt lease file succeeded")
+	}
+}
+
+// fakeLeaseAPI serves a Lease collection like the API server, keeping the
+// Lease in memory.
+type fakeLeaseAPI struct {
+	mu        sync.Mutex
+	lease     *k8sLease
+	version   int
+	writes    int
+	missing   bool // the namespace, every request is not found
+	conflict  bool // writes fail with a conflict
+	deleteGet bool // the Lease is deleted right after it is read
+}
+
+func (a *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	named := strings.HasSuffix(r.URL.Path, "/leases/lease")
+	if a.missing || (named && a.lease == nil) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && named:
+		json.NewEncoder(w).Encode(a.lease)
+		if a.deleteGet {
+			a.lease = nil
+		}
+		return
+	case r.Method == http.MethodPost && !named:
+		if a.lease != nil || a.conflict {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		var l k8sLease
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.lease = &l
+	case r.Method == http.MethodPatch && named:
+		var patch struct {
+			Metadata struct {
+				ResourceVersion string            `json:"resourceVersion"`
+				Annotations     map[string]string `json:"annotations"`
+			} `json:"metadata"`
+			Spec map[string]any `json:"spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.conflict || patch.Metadata.ResourceVersion != a.lease.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		for k, v := range patch.Metadata.Annotations {
+			a.lease.Metadata.Annotations[k] = v
+		}
+		// Merge the spec, null deletes a field
+		data, _ := json.Marshal(a.lease.Spec)
+		spec := make(map[string]any)
+		json.Unmarshal(data, &spec)
+		for k, v := range patch.Spec {
+			if v == nil {
+				delete(spec, k)
+			} else {
+				spec[k] = v
+			}
+		}
+		data, _ = json.Marshal(spec)
+		a.lease.Spec = k8sLease{}.Spec
+		json.Unmarshal(data, &a.lease.Spec)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.writes++
+	a.version++
+	a.lease.Metadata.ResourceVersion = strconv.Itoa(a.version)
+	json.NewEncoder(w).Encode(a.lease)
+}
+
+// store replaces the Lease with one holding l.
+func (a *fakeLeaseAPI) store(l lease) {
+	k := &k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	k.Metadata.Name, k.Metadata.Namespace, k.Metadata.ResourceVersion = "lease", "monitoring", "1"
+	k.Metadata.Annotations = map[string]string{leaseAddressAnnotation: l.Address, "other": "kept"}
+	k.Spec.HolderIdentity = l.Holder
+	k.Spec.LeaseDurationSeconds = int(l.Duration / time.Second)
+	k.Spec.RenewTime = l.RenewTime.UTC().Format(microTimeFormat)
+	k.Spec.LeaseTransitions = 1
+	a.lease, a.version = k, 1
+}
+
+func testKubernetesLease(t *testing.T, api *fakeLeaseAPI) *kubernetesLease {
+	t.Helper()
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &kubernetesLease{
+		name: "lease", namespace: "monitoring",
+		url:       srv.URL + "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases",
+		tokenFile: token,
+		client:    srv.Client(),
+	}
+}
+
+func TestKubernetesLeaseAcquire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	held := func(holder string, ago time.Duration) *lease {
+		return &lease{Holder: holder, Address: "http://" + holder, RenewTime: now.Add(-ago), Duration: 15 * time.Second}
+	}
+	tests := []struct {
+		name            string
+		stored          *lease
+		api             *fakeLeaseAPI
+		want            string // holder
+		wantWrites      int
+		wantTransitions int
+		wantStatus      int // of the error
+	}{
+		{name: "created", want: "a", wantWrites: 1},
+		{name: "created by another first", api: &fakeLeaseAPI{conflict: true}, want: ""},
+		{name: "renewed", stored: held("a", 5*time.Second), want: "a", wantWrites: 1, wantTransitions: 1},
+		{name: "held", stored: held("b", 5*time.Second), want: "b"},
+		{name: "expired", stored: held("b", time.Minute), want: "a", wantWrites: 1, wantTransitions: 2},
+		{name: "updated by another first", stored: held("b", time.Minute), api: &fakeLeaseAPI{conflict: true}, want: "b"},
+		{name: "namespace missing", api: &fakeLeaseAPI{missing: true}, wantStatus: http.StatusNotFound},
+		{name: "deleted before update", stored: held("a", 5*time.Second), api: &fakeLeaseAPI{deleteGet: true}, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := tt.api
+			if api == nil {
+				api = &fakeLeaseAPI{}
+			}
+			if tt.stored != nil {
+				api.store(*tt.stored)
+			}
+			k := testKubernetesLease(t, api)
+			l, err := k.acquire(context.Background(), lease{Holder: "a", Address: "http://a", RenewTime: now, Duration: 15 * time.Second})
+			if tt.wantStatus != 0 {
+				var status *httpStatusError
+				if !errors.As(err, &status) || status.StatusCode != tt.wantStatus {
+					t.Fatalf("acquire error = %v, want HTTP status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Holder != tt.want {
+				t.Errorf("lease held by %q, want %q", l.Holder, tt.want)
+			}
+			if api.writes != tt.wantWrites {
+				t.Errorf("%d writes, want %d", api.writes, tt.wantWrites)
+			}
+			if tt.wantWrites == 0 {
+				return
+			}
+			got := api.lease.lease()
+			if got.Holder != "a" || got.Address != "http://a" || !got.RenewTime.Equal(now) || got.Duration != 15*time.Second {
+				t.Errorf("stored lease %+v, want held by a renewed at %v", got, now)
+			}
+			if n := api.lease.Spec.LeaseTransitions; n != tt.wantTransitions {
+				t.Errorf("%d lease transitions, want %d", n, tt.wantTransitions)
+			}
+			if tt.stored != nil && api.lease.Metadata.Annotations["other"] != "kept" {
+				t.Errorf("annotations %v, want other annotations kept", api.lease.Metadata.Annotations)
+			}
+		})
+	}
+}
+
+func TestKubernetesLeaseRelease(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		holder   string // of the stored Lease, empty if none
+		want     string // holder afterwards
+		released bool
+	}{
+		{"held", "a", "", true},
+		{"held by another", "b", "b", false},
+		{"absent", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeLeaseAPI{}
+			if tt.holder != "" {
+				api.store(lease{Holder: tt.holder, RenewTime: now, Duration: time.Minute})
+			}
+			if err := testKubernetesLease(t, api).release(context.Background(), "a"); err != nil {
+				t.Fatal(err)
+			}
+			if (api.writes > 0) != tt.released {
+				t.Errorf("released = %v, want %v", api.writes > 0, tt.released)
+			}
+			if api.lease != nil && api.lease.Spec.HolderIdentity != tt.want {
+				t.Errorf("lease held by %q, want %q", api.lease.Spec.HolderIdentity, tt.want)
+			}
+			if tt.released && !api.lease.lease().expired(now.Add(2*time.Second)) {
+				t.Error("released lease not expired")
+			}
+		})
+	}
+}
+
+// stubLease is a leaseBackend held by holder, failing with err if set.
+type stubLease struct {
+	holder, address string
+	err             error
+}
+
+func (s *stubLease) acquire(_ context.Context, want lease) (lease, error) {
+	if s.err != nil {
+		return lease{}, s.err
+	}
+	if s.holder == want.Holder {
+		return want, nil
+	}
+	return lease{Holder: s.holder, Address: s.address}, nil
+}
+
+func (s *stubLease) release(context.Context, string) error { return nil }
+
+func TestElector(t *testing.T) {
+	since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	leaderState := testCollector(t, checkpointDataset("status"))
+	accumulate(leaderState.getZoneState(scopeZone, "z1"), leaderState.datasets[0], since, since.Add(time.Minute), checkpointWindow())
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/state" {
+			data, _ := leaderState.marshalState()
+			w.Write(data)
+			return
+		}
+		io.WriteString(w, "leader")
+	}))
+	defer leader.Close()
+
+	backend := &stubLease{}
+	restored := 0
+	e := &elector{
+		backend:  backend,
+		identity: "a",
+		address:  "http://a",
+		duration: 15 * time.Second,
+		reloader: newReloader(testCollector(t, checkpointDataset("status"))),
+		client:   leader.Client(),
+		restored: func() { restored++ },
+	}
+	h := e.route(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "local") }))
+	serve := func() (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, _ := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("before the first election: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	steps := []struct {
+		name         string
+		holder       string
+		err          error
+		stale        bool // last renewal longer than the renew deadline ago
+		wantLeading  bool
+		wantCode     int
+		wantBody     string
+		wantRestored int
+	}{
+		{name: "following", holder: "b", wantCode: 200, wantBody: "leader"},
+		{name: "elected", holder: "a", wantLeading: true, wantCode: 200, wantBody: "local", wantRestored: 1},
+		{name: "renewed", holder: "a", wantLeading: true, wantCode: 200, wantBody: "local", wantRestored: 1},
+		{name: "update failed", err: errors.New("unavailable"), wantLeading: true, wantCode: 200, wantBody: "local", wantRestored: 1},
+		{name: "update failed past the renew deadline", err: errors.New("unavailable"), stale: true, wantCode: 503, wantBody: "no leader elected\n", wantRestored: 1},
+		{name: "taken over", holder: "b", wantCode: 200, wantBody: "leader", wantRestored: 1},
+	}
+	for _, tt := range steps {
+		backend.holder, backend.address, backend.err = tt.holder, leader.URL, tt.err
+		if tt.stale {
+			e.lastRenew = time.Now().Add(-e.renewDeadline() - time.Second)
+		}
+		e.renew(context.Background())
+		if e.isLeader() != tt.wantLeading {
+			t.Errorf("%s: leading = %v, want %v", tt.name, e.isLeader(), tt.wantLeading)
+		}
+		if restored != tt.wantRestored {
+			t.Errorf("%s: restored %d times, want %d", tt.name, restored, tt.wantRestored)
+		}
+		if code, body := serve(); code != tt.wantCode || body != tt.wantBody {
+			t.Errorf("%s: served %d %q, want %d %q", tt.name, code, body, tt.wantCode, tt.wantBody)
+		}
+	}
+	zs := e.reloader.current().getZoneState(scopeZone, "z1")
+	if n := len(zs.counters["requests_total"]); n != 2 {
+		t.Errorf("%d series restored from the leader, want 2", n)
+	}
+}
+
+func TestElectorRenewDeadline(t *testing.T) {
+	e := &elector{
+		backend:  &stubLease{},
+		identity: "a",
+		address:  "http://a",
+		duration: 15 * time.Second,
+		reloader: newReloader(testCollector(t, checkpointDataset("status"))),
+		client:   http.DefaultClient,
+	}
+	e.lastRenew = time.Now()
+	e.takeOver()
+	if !e.isLeader() {
+		t.Fatal("not leading after takeover")
+	}
+
+	// Leadership ends at the deadline, before the next renewal attempt
+	e.lastRenew = time.Now().Add(-e.renewDeadline() - time.Second)
+	if e.isLeader() {
+		t.Error("still leading past the renew deadline")
+	}
+	rec := httptest.NewRecorder()
+	e.route(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("past the renew deadline: status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestElectorClientConfig(t *testing.T) {
+	leader := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "replica" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/-/state" {
+			io.WriteString(w, `{"targets":{}}`)
+			return
+		}
+		io.WriteString(w, "leader")
+	}))
+	defer leader.Close()
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leader.Certificate().Raw})
+	for name, data := range map[string]string{
+		"ca.crt":   string(ca),
+		"password": "secret\n",
+		"client.yml": "tls_config:\n  ca_file: ca.crt\n" +
+			"basic_auth:\n  username: replica\n  password_file: password\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := newElector(&Config{
+		HABackend:       haBackendFile,
+		HALeaseFile:     filepath.Join(dir, "lease"),
+		HALeaseDuration: 15,
+		HAIdentity:      "a",
+		HAAdvertiseURL:  "https://a",
+		HAClientConfig:  filepath.Join(dir, "client.yml"),
+	}, newReloader(testCollector(t, checkpointDataset("status"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.current = lease{Holder: "b", Address: leader.URL}
+
+	e.sync()
+	if string(e.synced) != `{"targets":{}}` {
+		t.Errorf("synced %q from the leader", e.synced)
+	}
+	rec := httptest.NewRecorder()
+	e.route(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "leader" {
+		t.Errorf("proxied %d %q, want 200 %q", rec.Code, rec.Body.String(), "leader")
+	}
+}
+
+func TestElectorMetrics(t *testing.T) {
+	served := prometheus.NewRegistry()
+	served.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.MustNewConstMetric(prometheus.NewDesc("cloudflare_zone_requests_total", "", nil, nil),
+			prometheus.CounterValue, 42)
+		ch <- prometheus.MustNewConstMetric(prometheus.NewDesc("cloudflare_exporter_ha_leader", "", []string{"identity"}, nil),
+			prometheus.GaugeValue, 1, "b")
+	}))
+	leader := httptest.NewServer(promhttp.HandlerFor(served, promhttp.HandlerOpts{}))
+	defer leader.Close()
+
+	e := &elector{
+		identity:   "a",
+		address:    "http://a",
+		duration:   15 * time.Second,
+		client:     leader.Client(),
+		leaderDesc: prometheus.NewDesc("cloudflare_exporter_ha_leader", "", []string{"identity"}, nil),
+	}
+	self := prometheus.NewRegistry()
+	self.MustRegister(e)
+	local := prometheus.NewRegistry()
+	local.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.MustNewConstMetric(prometheus.NewDesc("cloudflare_zone_requests_total", "", nil, nil),
+			prometheus.CounterValue, 1)
+	}))
+	h := e.metricsHandler(local, self, promhttp.HandlerOpts{})
+	serve := func() (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	steps := []struct {
+		name    string
+		current lease
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "no leader",
+			want:    []string{`cloudflare_exporter_ha_leader{identity="a"} 0`},
+			notWant: []string{"cloudflare_zone_requests_total"},
+		},
+		{
+			name:    "following",
+			current: lease{Holder: "b", Address: leader.URL},
+			want:    []string{`cloudflare_exporter_ha_leader{identity="a"} 0`, "cloudflare_zone_requests_total 42"},
+			notWant: []string{`identity="b"`},
+		},
+	}
+	for _, tt := range steps {
+		e.current = tt.current
+		code, body := serve()
+		if code != http.StatusOK {
+			t.Errorf("%s: status %d, body %q", tt.name, code, body)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: %q missing in\n%s", tt.name, s, body)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: unexpected %q in\n%s", tt.name, s, body)
+			}
+		}
+	}
+
+	e.lastRenew = time.Now()
+	e.leading.Store(true)
+	if _, body := serve(); !strings.Contains(body, "cloudflare_zone_requests_total 1") {
+		t.Errorf("leading: local metrics not served, got\n%s", body)
+	}
+
+	leader.Close()
+	e.leading.Store(false)
+	e.current = lease{Holder: "b", Address: leader.URL}
+	if code, _ := serve(); code != http.StatusInternalServerError {
+		t.Errorf("leader unreachable: status %d, want %d", code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small JSONPath subset for mapping GraphQL responses to metrics:
+// "$", ".name", "['name']", "[n]" and "[*]". A path without a leading "$"
+// is relative to the current value, so "sum.requests" and "$.sum.requests"
+// are equivalent.
+
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parsedPaths caches parsePath results; field paths are evaluated for every
+// group of every window.
+var parsedPaths sync.Map // string -> []pathSegment
+
+// parsePath splits a JSONPath expression into segments.
+func parsePath(path string) ([]pathSegment, error) {
+	if segs, ok := parsedPaths.Load(path); ok {
+		return segs.([]pathSegment), nil
+	}
+	segs, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	parsedPaths.Store(path, segs)
+	return segs, nil
+}
+
+func splitPath(path string) ([]pathSegment, error) {
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segs []pathSegment
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: unterminated [", path)
+			}
+			inner := strings.TrimSpace(p[1:end])
+			p = p[end+1:]
+			switch {
+			case inner == "*":
+				segs = append(segs, pathSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				segs = append(segs, pathSegment{key: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("path %q: invalid index %q", path, inner)
+				}
+				segs = append(segs, pathSegment{index: n, isIndex: true})
+			}
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if p[:end] == "*" {
+				segs = append(segs, pathSegment{wildcard: true})
+			} else {
+				segs = append(segs, pathSegment{key: p[:end]})
+			}
+			p = p[end:]
+		}
+	}
+	return segs, nil
+}
+
+// normalizePath rewrites a JSONPath expression to the canonical dotted form
+// used for field lookups ("$.sum['requests']" -> "sum.requests"). Keys that
+// aren't plain names stay bracketed ("['a.b']"), so they aren't split on
+// their dots when the canonical form is parsed again.
+func normalizePath(path string) (string, error) {
+	segs, err := parsePath(path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, s := range segs {
+		switch {
+		case s.wildcard:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteByte('*')
+		case s.isIndex:
+			b.WriteString("[" + strconv.Itoa(s.index) + "]")
+		case !fieldNameRE.MatchString(s.key):
+			quote := "'"
+			if strings.Contains(s.key, quote) {
+				quote = `"`
+			}
+			b.WriteString("[" + quote + s.key + quote + "]")
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(s.key)
+		}
+	}
+	return b.String(), nil
+}
+
+// fieldNameRE matches GraphQL field names, the keys written without brackets.
+var fieldNameRE = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// checkSelectable reports an error unless every segment of a path is a
+// GraphQL field name, as required for fields of generated queries.
+func checkSelectable(path string) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s.wildcard || s.isIndex || !fieldNameRE.MatchString(s.key) {
+			return fmt.Errorf("path %q: only field names are supported without a custom query", path)
+		}
+	}
+	return nil
+}
+
+// evalPath returns every value matched by path below v, in document order
+// for arrays and key order for objects, so the first match is stable.
+func evalPath(v interface{}, path string) []interface{} {
+	segs, err := parsePath(path)
+	if err != nil {
+		return nil
+	}
+	cur := []interface{}{v}
+	for _, s := range segs {
+		var next []interface{}
+		for _, c := range cur {
+			switch c := c.(type) {
+			case map[string]interface{}:
+				if s.wildcard {
+					for _, k := range sortedKeys(c) {
+						next = append(next, c[k])
+					}
+				} else if child, ok := c[s.key]; ok && !s.isIndex {
+					next = append(next, child)
+				}
+			case []interface{}:
+				switch {
+				case s.wildcard:
+					next = append(next, c...)
+				case s.isIndex && s.index >= 0 && s.index < len(c):
+					next = append(next, c[s.index])
+				case s.isIndex && s.index < 0 && -s.index <= len(c):
+					next = append(next, c[len(c)+s.index])
+				}
+			}
+		}
+		cur = next
+	}
+	return cur
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEvalPath(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{
+		"viewer": {"zones": [{"groups": [
+			{"count": 1, "dimensions": {"status": 200}},
+			{"count": 2, "dimensions": {"status": 404}}
+		]}]},
+		"odd key": "x",
+		"a.b": {"c": 3},
+		"a": {"b": {"c": 4}},
+		"hosts": {"b": 2, "d": 4, "a": 1, "c": 3}
+	}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"$", []interface{}{doc}},
+		{"viewer.zones[0].groups[*].count", []interface{}{1.0, 2.0}},
+		{"$.viewer.zones[0].groups[*].count", []interface{}{1.0, 2.0}},
+		{"viewer.zones.*.groups.*.dimensions.status", []interface{}{200.0, 404.0}},
+		{"viewer['zones'][0][\"groups\"][-1].count", []interface{}{2.0}},
+		{"['odd key']", []interface{}{"x"}},
+		{"['a.b'].c", []interface{}{3.0}},
+		{"a.b.c", []interface{}{4.0}},
+		{"hosts.*", []interface{}{1.0, 2.0, 3.0, 4.0}},
+		{"viewer.zones[1]", nil},
+		{"viewer.zones[-2]", nil},
+		{"viewer.missing.count", nil},
+		{"viewer.zones.groups", nil}, // keys don't apply to arrays
+		{"viewer[", nil},             // invalid
+	}
+	for _, tt := range tests {
+		if got := evalPath(doc, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("evalPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path, want string
+		err        bool
+	}{
+		{"sum.requests", "sum.requests", false},
+		{"$.sum['requests']", "sum.requests", false},
+		{"$['sum'][\"countryMap\"][*].requests", "sum.countryMap.*.requests", false},
+		{"groups[0].count", "groups[0].count", false},
+		{"$['a.b'].c", "['a.b'].c", false},
+		{"x[\"it's\"]", "x[\"it's\"]", false},
+		{"[*][0]", "*[0]", false},
+		{"sum[requests]", "", true},
+		{"sum[0", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizePath(tt.path)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, %v, want %q (error %v)", tt.path, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNormalizePathRoundTrip(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"a.b": {"c": 1}, "a": {"b": {"c": 2}}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]float64{"['a.b'].c": 1, "$.a['b'].c": 2} {
+		field, err := normalizePath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lookupField(doc, field); got != want {
+			t.Errorf("lookupField(%q) = %v, want %v", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setupLogging installs the default slog logger from LOG_LEVEL, LOG_FORMAT
+// and LOG_REPEAT_INTERVAL. The standard log package, used by dependencies,
+// is routed through it as well.
+func setupLogging() error {
+	var level slog.Level
+	if l := os.Getenv("LOG_LEVEL"); l != "" {
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			return fmt.Errorf("LOG_LEVEL invalid: %q", l)
+		}
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		// Durations as "1.5s" rather than nanoseconds in both formats
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch f := os.Getenv("LOG_FORMAT"); f {
+	case "", "logfmt":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be \"logfmt\" or \"json\", got %q", f)
+	}
+
+	repeat, err := envInt("LOG_REPEAT_INTERVAL", 300)
+	if err != nil {
+		return err
+	}
+	if repeat > 0 {
+		handler = newRepeatHandler(handler, time.Duration(repeat)*time.Second)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// --- repeated error suppression ---
+
+// repeatKeys are the attributes identifying "the same" warning or error.
+// Volatile attributes (window, duration, the error text) are left out.
+var repeatKeys = map[string]bool{
+	"zone": true, "account_id": true, "dataset": true, "sink": true, "error_class": true,
+}
+
+// repeatHandler drops warnings and errors identical to one logged within
+// the interval. The next one logged after the interval carries the number
+// of dropped records as "repeated".
+type repeatHandler struct {
+	slog.Handler
+	state *repeatState
+	key   string // identifying attributes added via WithAttrs
+}
+
+type repeatState struct {
+	mu       sync.Mutex
+	interval time.Duration
+	seen     map[string]*repeatEntry
+}
+
+type repeatEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newRepeatHandler(h slog.Handler, interval time.Duration) *repeatHandler {
+	return &repeatHandler{
+		Handler: h,
+		state:   &repeatState{interval: interval, seen: make(map[string]*repeatEntry)},
+	}
+}
+
+func repeatKey(a slog.Attr) string {
+	if !repeatKeys[a.Key] {
+		return ""
+	}
+	return a.Key + "=" + a.Value.String() + "\x00"
+}
+
+func (h *repeatHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	key := r.Level.String() + "\x00" + r.Message + "\x00" + h.key
+	r.Attrs(func(a slog.Attr) bool {
+		key += repeatKey(a)
+		return true
+	})
+
+	s := h.state
+	s.mu.Lock()
+	e, ok := s.seen[key]
+	if ok && r.Time.Sub(e.logged) < s.interval {
+		e.suppressed++
+		s.mu.Unlock()
+		return nil
+	}
+	suppressed := 0
+	if ok {
+		suppressed = e.suppressed
+	}
+	s.seen[key] = &repeatEntry{logged: r.Time}
+	if len(s.seen) > 1000 {
+		for k, e := range s.seen {
+			if r.Time.Sub(e.logged) >= s.interval {
+				delete(s.seen, k)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("repeated", suppressed))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *repeatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	key := h.key
+	for _, a := range attrs {
+		key += repeatKey(a)
+	}
+	return &repeatHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state, key: key}
+}
+
+func (h *repeatHandler) WithGroup(name string) slog.Handler {
+	return &repeatHandler{Handler: h.Handler.WithGroup(name), state: h.state, key: h.key + name + "."}
+}
+
+// --- error classes ---
+
+// httpStatusError is a non-2xx response from an API.
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// graphqlError is an error returned in a GraphQL response body. Code is
+// the machine-readable code of its extensions, empty if there was none.
+type graphqlError struct {
+	Message string
+	Code    string
+}
+
+func (e *graphqlError) Error() string {
+	return "graphql error: " + e.Message
+}
+
+// graphqlCodeClasses maps the extensions codes of GraphQL errors to error
+// classes, other codes are class graphql. Errors without a code are
+// classified by their message.
+var graphqlCodeClasses = map[string]string{
+	"authz": "unavailable", // the zone or account has no access to the node
+}
+
+// isUnavailable reports whether a query was rejected because the zone or
+// account isn't entitled to the data, e.g. a dataset its plan lacks.
+func isUnavailable(err error) bool {
+	return errorClass(err) == "unavailable"
+}
+
+// errorClass buckets an error into a small set of classes for log filtering.
+func errorClass(err error) string {
+	var (
+		statusErr *httpStatusError
+		gqlErr    *graphqlError
+		netErr    net.Error
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, errBudgetExhausted):
+		return "budget"
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.StatusCode == 401 || statusErr.StatusCode == 403:
+			return "auth"
+		case statusErr.StatusCode == 429:
+			return "rate_limited"
+		case statusErr.StatusCode >= 500:
+			return "server"
+		}
+		return "http"
+	case errors.As(err, &gqlErr):
+		if gqlErr.Code != "" {
+			if class, ok := graphqlCodeClasses[gqlErr.Code]; ok {
+				return class
+			}
+			return "graphql"
+		}
+		// Errors without a code can only be told apart by their wording
+		msg := strings.ToLower(gqlErr.Message)
+		switch {
+		case strings.Contains(msg, "not authorized") || strings.Contains(msg, "authentication"):
+			return "auth"
+		case strings.Contains(msg, "rate limit"):
+			return "rate_limited"
+		case strings.Contains(msg, "does not have access") || strings.Contains(msg, "not available") ||
+			strings.Contains(msg, "not entitled"):
+			return "unavailable"
+		}
+		return "graphql"
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	return "other"
+}
+
+// errAttrs returns the error and its class as log attributes.
+func errAttrs(err error) []any {
+	return []any{"error", err, "error_class", errorClass(err)}
+}
+
+// windowAttr formats a query window as an ISO 8601 interval.
+func windowAttr(since, until time.Time) slog.Attr {
+	return slog.String("window", since.UTC().Format(time.RFC3339)+"/"+until.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("query: %w", errBudgetExhausted), "budget"},
+		{&httpStatusError{StatusCode: 403}, "auth"},
+		{&httpStatusError{StatusCode: 429}, "rate_limited"},
+		{&httpStatusError{StatusCode: 502}, "server"},
+		{&httpStatusError{StatusCode: 400}, "http"},
+		{&graphqlError{Message: "not authorized for that account"}, "auth"},
+		{&graphqlError{Message: "rate limiter budget depleted, try again after 5 minutes"}, "rate_limited"},
+		{&graphqlError{Message: "zone 'x' does not have access to the path"}, "unavailable"},
+		{&graphqlError{Message: "Cache Reserve is not available for this zone"}, "unavailable"},
+		{&graphqlError{Message: "unknown field"}, "graphql"},
+		{&graphqlError{Message: "zone 'x' does not have access to the path", Code: "authz"}, "unavailable"},
+		{&graphqlError{Message: "access to this dataset is restricted", Code: "authz"}, "unavailable"},
+		{&graphqlError{Message: "dataset is not available right now", Code: "internal"}, "graphql"},
+		{fmt.Errorf("other"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRepeatHandler(t *testing.T) {
+	var out strings.Builder
+	base := slog.NewTextHandler(&out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	const interval = time.Minute
+	h := newRepeatHandler(base, interval)
+	zoneH := h.WithAttrs([]slog.Attr{slog.String("zone", "z1")})
+	t0 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		handler slog.Handler
+		at      time.Duration
+		level   slog.Level
+		attrs   []any
+		want    string // logged line, empty if suppressed
+	}{
+		{"first", h, 0, slog.LevelWarn, []any{"zone", "z1", "error", "a"},
+			"level=WARN msg=failed zone=z1 error=a\n"},
+		{"repeat", h, time.Second, slog.LevelWarn, []any{"zone", "z1", "error", "b"}, ""},
+		{"repeat via WithAttrs", zoneH, 2 * time.Second, slog.LevelWarn, []any{"error", "c"}, ""},
+		{"other zone", h, 3 * time.Second, slog.LevelWarn, []any{"zone", "z2", "error", "a"},
+			"level=WARN msg=failed zone=z2 error=a\n"},
+		{"other level", h, 4 * time.Second, slog.LevelError, []any{"zone", "z1", "error", "a"},
+			"level=ERROR msg=failed zone=z1 error=a\n"},
+		{"info not suppressed", h, 5 * time.Second, slog.LevelInfo, []any{"zone", "z1"},
+			"level=INFO msg=failed zone=z1\n"},
+		{"info again", h, 6 * time.Second, slog.LevelInfo, []any{"zone", "z1"},
+			"level=INFO msg=failed zone=z1\n"},
+		{"after interval", h, interval, slog.LevelWarn, []any{"zone", "z1", "error", "d"},
+			"level=WARN msg=failed zone=z1 error=d repeated=2\n"},
+		{"repeat after interval", h, interval + time.Second, slog.LevelWarn, []any{"zone", "z1", "error", "e"}, ""},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		r := slog.NewRecord(t0.Add(tt.at), tt.level, "failed", 0)
+		r.Add(tt.attrs...)
+		if err := tt.handler.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: logged %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,55 +1,190 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.yaml.in/yaml/v2"
 )
 
 var version = "dev"
 
+var webConfigFlag = flag.String("web.config.file", "", "path to a web config file enabling TLS and/or basic auth (default $WEB_CONFIG_FILE)")
+
 type Config struct {
-	APIKey      string
-	APIEmail    string
-	APIToken    string
-	Zones       []string
-	Port        int
-	ScrapeDelay int // seconds - how far back to query
+	Credentials []*Credential
+	// AccountLabel adds the credential name as "account" label, set when
+	// credentials are defined in the config file.
+	AccountLabel bool
+	Port         int
+	ScrapeDelay  int // seconds - how far back to query
+	ConfigFile   string
+	Datasets     []*Dataset
+	Modules      map[string][]*Dataset // /probe modules, by name
+	Exemplars    bool                  // attach sampled Ray IDs to status counters (OpenMetrics only)
+	// DataTimestamps exports hour-bucketed datasets with the end of their
+	// data window as sample timestamp instead of the scrape time.
+	DataTimestamps bool
+
+	// Polling: collect every PollInterval seconds instead of on scrape.
+	// Required by push outputs; Port 0 disables the HTTP listener.
+	PollInterval    int
+	OTLPEndpoint    string
+	OTLPHeaders     map[string]string
+	OTLPTemporality string
+
+	RemoteWriteURL        string
+	RemoteWriteHeaders    map[string]string
+	RemoteWriteBatchSize  int    // samples per request
+	RemoteWriteMaxPending int    // undelivered batches kept before dropping the oldest
+	RemoteWriteWALDir     string // persist undelivered batches across restarts
+
+	DumpFile string // JSON lines of every fetched window, - for stdout
+
+	WebConfigFile string // exporter-toolkit web config (TLS, basic auth)
+
+	CredentialReloadInterval int // seconds between re-reads of secret files
+
+	APIBudget        int // GraphQL requests per 5 minutes per credential, 0 for no limit
+	APIBudgetMaxWait int // seconds a query may wait for budget before it is deferred
+
+	CatchUpMaxAge    int // seconds - how far back a gap in data is caught up
+	CatchUpMaxChunks int // queries per dataset and scrape while catching up
+
+	StateFile           string // checkpoint of accumulated state, saved on shutdown
+	ShutdownGracePeriod int    // seconds to let in-flight polls and scrapes finish
+	ShutdownDrainDelay  int    // seconds to keep serving after failing readiness
+
+	// Sharding: zones and accounts are split across ShardCount instances
+	ShardIndex int
+	ShardCount int
+
+	// HA: replicas elect a leader, the only one collecting from Cloudflare
+	HABackend        string // "file" or "kubernetes", empty disables HA
+	HALeaseFile      string
+	HALeaseName      string // Kubernetes Lease
+	HALeaseNamespace string
+	HALeaseDuration  int    // seconds
+	HAIdentity       string // this replica, default hostname
+	HAAdvertiseURL   string // base URL followers reach this replica at
+	HAClientConfig   string // HTTP client config file for requests to the leader
 }
 
-func loadConfig() (*Config, error) {
-	cfg := &Config{
-		APIKey:      os.Getenv("CF_API_KEY"),
-		APIEmail:    os.Getenv("CF_API_EMAIL"),
-		APIToken:    os.Getenv("CF_API_TOKEN"),
-		Port:        8080,
-		ScrapeDelay: 300,
+// fileConfig is the optional YAML config file set via CONFIG_FILE.
+type fileConfig struct {
+	// Datasets are added to the built-in datasets, replacing any with the same name.
+	Datasets []*Dataset `yaml:"datasets"`
+	// Queries are custom GraphQL queries mapped to metrics via JSONPath.
+	Queries []*Dataset `yaml:"queries"`
+	// EnabledDatasets are collected although opt-in, e.g. http_latency.
+	EnabledDatasets []string `yaml:"enabled_datasets"`
+	// DisabledDatasets are not collected, built-in or custom.
+	DisabledDatasets []string `yaml:"disabled_datasets"`
+	// Intervals set the interval of datasets by name, e.g. "dns: 5m".
+	Intervals map[string]time.Duration `yaml:"intervals"`
+	// Modules are named dataset sets for /probe.
+	Modules map[string]*Module `yaml:"modules"`
+	// Credentials are named API tokens with the zones and accounts to
+	// collect with each, in addition to the CF_* environment variables.
+	Credentials []*Credential `yaml:"credentials"`
+}
+
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc fileConfig
+	if err := yaml.UnmarshalStrict(data, &fc); err != nil {
+		return nil, err
+	}
+	return &fc, nil
+}
+
+// webConfigTLS reports whether the web config file at path serves TLS.
+func webConfigTLS(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var wc struct {
+		TLS struct {
+			Cert     string `yaml:"cert"`
+			CertFile string `yaml:"cert_file"`
+		} `yaml:"tls_server_config"`
+	}
+	if err := yaml.Unmarshal(data, &wc); err != nil {
+		return false, err
 	}
+	return wc.TLS.Cert != "" || wc.TLS.CertFile != "", nil
+}
 
-	// Auth: either token or key+email
-	if cfg.APIToken == "" && (cfg.APIKey == "" || cfg.APIEmail == "") {
-		return nil, fmt.Errorf("set CF_API_TOKEN or both CF_API_KEY and CF_API_EMAIL")
+// envBool parses an optional boolean environment variable.
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s invalid: %w", name, err)
 	}
+	return b, nil
+}
 
-	// Zones
-	zones := os.Getenv("CF_ZONES")
-	if zones == "" {
-		return nil, fmt.Errorf("CF_ZONES is required (comma-separated zone IDs)")
+// envInt parses an optional integer environment variable.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s invalid: %w", name, err)
 	}
-	for _, z := range strings.Split(zones, ",") {
-		z = strings.TrimSpace(z)
-		if z != "" {
-			cfg.Zones = append(cfg.Zones, z)
+	return i, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
 		}
 	}
-	if len(cfg.Zones) == 0 {
-		return nil, fmt.Errorf("CF_ZONES must contain at least one zone ID")
+	return out
+}
+
+func loadConfig() (*Config, error) {
+	var err error
+	cfg := &Config{
+		ConfigFile:  os.Getenv("CONFIG_FILE"),
+		Port:        8080,
+		ScrapeDelay: 300,
+	}
+
+	// Auth: either token or key+email, bound to CF_ZONES (optional when
+	// zones are only probed via /probe) and CF_ACCOUNTS
+	envCred, err := envCredential()
+	if err != nil {
+		return nil, err
 	}
 
 	// Optional port
@@ -70,38 +205,472 @@ func loadConfig() (*Config, error) {
 		cfg.ScrapeDelay = delay
 	}
 
+	// Optional Ray ID exemplars and data window timestamps
+	if cfg.Exemplars, err = envBool("EXEMPLARS", false); err != nil {
+		return nil, err
+	}
+	// Remote write defaults to data timestamps so every window lands at its own time
+	cfg.RemoteWriteURL = os.Getenv("REMOTE_WRITE_URL")
+	if cfg.DataTimestamps, err = envBool("DATA_TIMESTAMPS", cfg.RemoteWriteURL != ""); err != nil {
+		return nil, err
+	}
+
+	// Optional polling and OTLP push
+	if p := os.Getenv("POLL_INTERVAL"); p != "" {
+		interval, err := strconv.Atoi(p)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("POLL_INTERVAL invalid: %q", p)
+		}
+		cfg.PollInterval = interval
+	}
+	cfg.OTLPEndpoint = os.Getenv("OTLP_ENDPOINT")
+	if cfg.OTLPHeaders, err = parseHeaders(os.Getenv("OTLP_HEADERS")); err != nil {
+		return nil, fmt.Errorf("OTLP_HEADERS: %w", err)
+	}
+	cfg.OTLPTemporality = temporalityCumulative
+	if t := os.Getenv("OTLP_TEMPORALITY"); t != "" {
+		if t != temporalityCumulative && t != temporalityDelta {
+			return nil, fmt.Errorf("OTLP_TEMPORALITY must be %q or %q", temporalityCumulative, temporalityDelta)
+		}
+		cfg.OTLPTemporality = t
+	}
+
+	// Optional remote write
+	if cfg.RemoteWriteHeaders, err = parseHeaders(os.Getenv("REMOTE_WRITE_HEADERS")); err != nil {
+		return nil, fmt.Errorf("REMOTE_WRITE_HEADERS: %w", err)
+	}
+	if cfg.RemoteWriteBatchSize, err = envInt("REMOTE_WRITE_BATCH_SIZE", 2000); err != nil {
+		return nil, err
+	}
+	if cfg.RemoteWriteMaxPending, err = envInt("REMOTE_WRITE_MAX_PENDING", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.RemoteWriteBatchSize <= 0 || cfg.RemoteWriteMaxPending <= 0 {
+		return nil, fmt.Errorf("REMOTE_WRITE_BATCH_SIZE and REMOTE_WRITE_MAX_PENDING must be positive")
+	}
+	cfg.RemoteWriteWALDir = os.Getenv("REMOTE_WRITE_WAL_DIR")
+
+	// Optional TLS and basic auth, validated here to fail fast
+	cfg.WebConfigFile = os.Getenv("WEB_CONFIG_FILE")
+	if *webConfigFlag != "" {
+		cfg.WebConfigFile = *webConfigFlag
+	}
+	if cfg.WebConfigFile != "" {
+		if err := web.Validate(cfg.WebConfigFile); err != nil {
+			return nil, fmt.Errorf("WEB_CONFIG_FILE: %w", err)
+		}
+	}
+
+	if cfg.CredentialReloadInterval, err = envInt("CREDENTIAL_RELOAD_INTERVAL", 30); err != nil {
+		return nil, err
+	}
+	if cfg.CredentialReloadInterval <= 0 {
+		return nil, fmt.Errorf("CREDENTIAL_RELOAD_INTERVAL must be positive")
+	}
+
+	// GraphQL request budget per credential
+	if cfg.APIBudget, err = envInt("API_BUDGET", 300); err != nil {
+		return nil, err
+	}
+	if cfg.APIBudgetMaxWait, err = envInt("API_BUDGET_MAX_WAIT", 10); err != nil {
+		return nil, err
+	}
+	if cfg.APIBudget < 0 || cfg.APIBudgetMaxWait < 0 {
+		return nil, fmt.Errorf("API_BUDGET and API_BUDGET_MAX_WAIT must not be negative")
+	}
+
+	// Catch-up of windows longer than a dataset's max window
+	if cfg.CatchUpMaxAge, err = envInt("CATCH_UP_MAX_AGE", 86400); err != nil {
+		return nil, err
+	}
+	if cfg.CatchUpMaxChunks, err = envInt("CATCH_UP_MAX_CHUNKS", 6); err != nil {
+		return nil, err
+	}
+	if cfg.CatchUpMaxAge <= 0 || cfg.CatchUpMaxChunks <= 0 {
+		return nil, fmt.Errorf("CATCH_UP_MAX_AGE and CATCH_UP_MAX_CHUNKS must be positive")
+	}
+
+	// Shutdown and state checkpoint
+	cfg.StateFile = os.Getenv("STATE_FILE")
+	if cfg.ShutdownGracePeriod, err = envInt("SHUTDOWN_GRACE_PERIOD", 25); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownDrainDelay, err = envInt("SHUTDOWN_DRAIN_DELAY", 5); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownDrainDelay < 0 || cfg.ShutdownDrainDelay > cfg.ShutdownGracePeriod {
+		return nil, fmt.Errorf("SHUTDOWN_DRAIN_DELAY must be between 0 and SHUTDOWN_GRACE_PERIOD")
+	}
+
+	// Optional sharding, the flags take precedence
+	if err := loadShard(cfg); err != nil {
+		return nil, err
+	}
+
+	// Optional HA leader election
+	cfg.HABackend = os.Getenv("HA_BACKEND")
+	cfg.HALeaseFile = os.Getenv("HA_LEASE_FILE")
+	cfg.HALeaseName = os.Getenv("HA_LEASE_NAME")
+	if cfg.HALeaseName == "" {
+		cfg.HALeaseName = "cloudflare-exporter"
+	}
+	cfg.HALeaseNamespace = os.Getenv("HA_LEASE_NAMESPACE")
+	if cfg.HALeaseDuration, err = envInt("HA_LEASE_DURATION", 15); err != nil {
+		return nil, err
+	}
+	switch cfg.HABackend {
+	case "", haBackendKubernetes:
+	case haBackendFile:
+		if cfg.HALeaseFile == "" {
+			return nil, fmt.Errorf("HA_BACKEND=file requires HA_LEASE_FILE")
+		}
+	default:
+		return nil, fmt.Errorf("HA_BACKEND must be %q or %q, got %q", haBackendFile, haBackendKubernetes, cfg.HABackend)
+	}
+	if cfg.HABackend != "" {
+		if cfg.Port == 0 {
+			return nil, fmt.Errorf("HA_BACKEND requires METRICS_PORT, followers reach the leader over HTTP")
+		}
+		if cfg.HALeaseDuration < 3 {
+			return nil, fmt.Errorf("HA_LEASE_DURATION must be at least 3")
+		}
+		host, _ := os.Hostname()
+		if cfg.HAIdentity = os.Getenv("HA_IDENTITY"); cfg.HAIdentity == "" {
+			cfg.HAIdentity = host
+		}
+		if ip := os.Getenv("POD_IP"); ip != "" {
+			host = ip
+		}
+		scheme := "http"
+		if cfg.WebConfigFile != "" {
+			withTLS, err := webConfigTLS(cfg.WebConfigFile)
+			if err != nil {
+				return nil, fmt.Errorf("WEB_CONFIG_FILE: %w", err)
+			}
+			if withTLS {
+				scheme = "https"
+			}
+		}
+		if cfg.HAAdvertiseURL = strings.TrimSuffix(os.Getenv("HA_ADVERTISE_URL"), "/"); cfg.HAAdvertiseURL == "" {
+			cfg.HAAdvertiseURL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(cfg.Port)))
+		}
+		if u, err := url.Parse(cfg.HAAdvertiseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("HA_ADVERTISE_URL must be an http:// or https:// URL, got %q", cfg.HAAdvertiseURL)
+		}
+		if cfg.HAClientConfig = os.Getenv("HA_CLIENT_CONFIG"); cfg.HAClientConfig != "" {
+			if _, err := loadHTTPClientConfig(cfg.HAClientConfig); err != nil {
+				return nil, fmt.Errorf("HA_CLIENT_CONFIG: %w", err)
+			}
+		}
+	}
+
+	// Optional window dump, the --dump flag takes precedence
+	cfg.DumpFile = os.Getenv("DUMP_FILE")
+	if *dumpFlag != "" {
+		cfg.DumpFile = *dumpFlag
+	}
+
+	pushing := cfg.OTLPEndpoint != "" || cfg.RemoteWriteURL != ""
+	if pushing && cfg.PollInterval == 0 {
+		cfg.PollInterval = 60
+	}
+	if cfg.Port == 0 && !pushing && cfg.DumpFile == "" {
+		return nil, fmt.Errorf("METRICS_PORT=0 requires a push output (OTLP_ENDPOINT or REMOTE_WRITE_URL) or a dump")
+	}
+	if cfg.Port == 0 && cfg.PollInterval == 0 {
+		// Dump-only: nothing scrapes, so poll
+		cfg.PollInterval = 60
+	}
+
+	// Optional config file with custom datasets and queries
+	var custom []*Dataset
+	var modules map[string]*Module
+	var fileCreds []*Credential
+	var enabled, disabled []string
+	var intervals map[string]time.Duration
+	if cfg.ConfigFile != "" {
+		fc, err := loadConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+		}
+		custom, modules, fileCreds, disabled = fc.Datasets, fc.Modules, fc.Credentials, fc.DisabledDatasets
+		enabled, intervals = fc.EnabledDatasets, fc.Intervals
+		for _, q := range fc.Queries {
+			if q.Query == "" {
+				return nil, fmt.Errorf("CONFIG_FILE: query %q: query is required", q.Name)
+			}
+			custom = append(custom, q)
+		}
+	}
+	datasets, err := mergeDatasets(builtinDatasets(), custom)
+	if err != nil {
+		return nil, fmt.Errorf("datasets: %w", err)
+	}
+	if datasets, err = selectDatasets(datasets, enabled, disabled); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	if err := setIntervals(datasets, intervals); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	cfg.Datasets = datasets
+	if cfg.Credentials, err = mergeCredentials(envCred, fileCreds); err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	cfg.AccountLabel = len(fileCreds) > 0
+	if cfg.Modules, err = resolveModules(modules, datasets); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+
 	return cfg, nil
 }
 
 func main() {
+	if err := setupLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			fatal("backfill failed", "error", err)
+		}
+		return
+	}
+	flag.Parse()
+
 	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("config error: %v", err)
+		fatal("config error", "error", err)
 	}
 
-	log.Printf("cloudflare-exporter %s starting on :%d", version, cfg.Port)
-	log.Printf("zones: %v, scrape_delay: %ds", cfg.Zones, cfg.ScrapeDelay)
+	slog.Info("cloudflare-exporter starting", "version", version, "port", cfg.Port)
+	for _, cred := range cfg.Credentials {
+		slog.Info("credential", "account", cred.Name, "zones", cred.Zones, "accounts", cred.Accounts)
+	}
+	slog.Info("configuration", "scrape_delay", cfg.ScrapeDelay, "datasets", len(cfg.Datasets))
+	if cfg.ShardCount > 1 {
+		slog.Info("sharding", "shard_index", cfg.ShardIndex, "shard_count", cfg.ShardCount)
+	}
 
-	client := NewGraphQLClient(cfg)
-	collector := NewCloudflareCollector(cfg, client)
+	collector := NewCloudflareCollector(cfg)
+	if cfg.DumpFile != "" {
+		d, err := newDumper(cfg.DumpFile)
+		if err != nil {
+			fatal("dump: open failed", "error", err)
+		}
+		collector.dump = d
+		slog.Info("dumping fetched windows", "file", cfg.DumpFile)
+	}
 
+	// Reloads swap the collector, keeping the state of remaining targets
+	reloader := newReloader(collector)
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(collector)
+	registry.MustRegister(uncheckedCollector(reloader.Collect))
+
+	// With HA only the leader collects, followers proxy to it and serve
+	// their own exporter metrics from self
+	var ha *elector
+	var self *prometheus.Registry
+	if cfg.HABackend != "" {
+		if ha, err = newElector(cfg, reloader); err != nil {
+			fatal("config error", "error", err)
+		}
+		registry.MustRegister(ha)
+		self = prometheus.NewRegistry()
+		self.MustRegister(uncheckedCollector(reloader.collectSelf), ha)
+		slog.Info("HA leader election", "backend", cfg.HABackend, "identity", cfg.HAIdentity, "address", cfg.HAAdvertiseURL)
+	}
 
+	// In polling mode /metrics serves the latest snapshot instead of
+	// querying Cloudflare on every scrape.
+	var gatherer prometheus.Gatherer = registry
+	var poller *Poller
+	var otlp *otlpSink
+	if cfg.PollInterval > 0 {
+		var sinks []Sink
+		if cfg.OTLPEndpoint != "" {
+			slog.Info("pushing OTLP metrics", "endpoint", cfg.OTLPEndpoint, "temporality", cfg.OTLPTemporality)
+			otlp = newOTLPSink(cfg.OTLPEndpoint, cfg.OTLPHeaders, cfg.OTLPTemporality)
+			sinks = append(sinks, otlp)
+		}
+		if cfg.RemoteWriteURL != "" {
+			slog.Info("remote writing metrics", "url", cfg.RemoteWriteURL)
+			rw, err := newRemoteWriteSink(cfg.RemoteWriteURL, cfg.RemoteWriteHeaders,
+				cfg.RemoteWriteBatchSize, cfg.RemoteWriteMaxPending, cfg.RemoteWriteWALDir)
+			if err != nil {
+				fatal("config error", "error", err)
+			}
+			sinks = append(sinks, rw)
+		}
+		poller = NewPoller(registry, time.Duration(cfg.PollInterval)*time.Second, sinks...)
+		if ha != nil {
+			poller.active = ha.isLeader
+		}
+		gatherer = poller
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	grace := time.Duration(cfg.ShutdownGracePeriod) * time.Second
+
+	if cfg.StateFile != "" {
+		if err := collector.loadState(cfg.StateFile); err != nil {
+			fatal("state: load failed", "file", cfg.StateFile, "error", err)
+		}
+	}
+	if otlp != nil {
+		// Restored totals were already pushed, deltas continue from them
+		seed := func() {
+			state, err := reloader.current().stateFamilies()
+			if err != nil {
+				slog.Warn("otlp: seeding restored state failed", "error", err)
+			}
+			otlp.seed(state, time.Now())
+		}
+		seed()
+		if ha != nil {
+			ha.restored = seed
+		}
+	}
+	go watchCredentials(ctx, func() []*Credential { return reloader.current().cfg.Credentials },
+		time.Duration(cfg.CredentialReloadInterval)*time.Second)
+	go reloader.watch(ctx)
+	if ha != nil {
+		go ha.run(ctx)
+	}
+
+	pollerDone := make(chan struct{})
+	if poller != nil {
+		go func() {
+			defer close(pollerDone)
+			poller.Run(ctx)
+		}()
+	} else {
+		close(pollerDone)
+	}
+
+	if cfg.Port == 0 {
+		slog.Info("metrics endpoint disabled", "poll_interval", cfg.PollInterval)
+		<-ctx.Done()
+		slog.Info("shutting down", "grace_period", grace)
+		waitTimeout(pollerDone, grace)
+		closeDump(collector.dump)
+		saveState(reloader.current(), cfg.StateFile)
+		return
+	}
+
+	var ready atomic.Bool
+	ready.Store(true)
+
+	// Data endpoints are served by the leader only
+	data := func(h http.Handler) http.Handler {
+		if ha == nil {
+			return h
+		}
+		return ha.route(h)
+	}
+	metricsOpts := promhttp.HandlerOpts{
+		// Exemplars are only served in the OpenMetrics format
+		EnableOpenMetrics: cfg.Exemplars,
+	}
+	metrics := promhttp.HandlerFor(gatherer, metricsOpts)
+	if ha != nil {
+		metrics = ha.metricsHandler(gatherer, self, metricsOpts)
+	}
+
+	// With WEB_CONFIG_FILE, every endpoint including /-/state requires
+	// authentication
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/probe", data(reloader.serve((*CloudflareCollector).probeHandler)))
+	mux.Handle("GET /influx", data(reloader.serve((*CloudflareCollector).influxHandler)))
+	mux.Handle("GET /api/v1/zones/{id}", data(reloader.serve(func(c *CloudflareCollector, w http.ResponseWriter, r *http.Request) {
+		c.targetHandler(scopeZone)(w, r)
+	})))
+	mux.Handle("GET /api/v1/accounts/{id}", data(reloader.serve(func(c *CloudflareCollector, w http.ResponseWriter, r *http.Request) {
+		c.targetHandler(scopeAccount)(w, r)
+	})))
+	mux.HandleFunc("POST /-/reload", reloader.reloadHandler)
+	if ha != nil {
+		mux.HandleFunc("GET /-/state", ha.stateHandler)
+	}
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "ok")
 	})
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "ok")
 	})
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: mux,
+	server := &http.Server{Handler: mux}
+	listen := []string{fmt.Sprintf(":%d", cfg.Port)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- web.ListenAndServe(server, &web.FlagConfig{
+			WebListenAddresses: &listen,
+			WebSystemdSocket:   new(bool),
+			WebConfigFile:      &cfg.WebConfigFile,
+		}, slog.Default())
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("listen failed", "error", err)
+	case <-ctx.Done():
+	}
+
+	// Fail readiness first so no new scrapes are routed here, keep serving
+	// until load balancers noticed and the current poll finished, then
+	// drain in-flight scrapes.
+	slog.Info("shutting down", "grace_period", grace)
+	ready.Store(false)
+	deadline := time.Now().Add(grace)
+	drained := time.After(time.Duration(cfg.ShutdownDrainDelay) * time.Second)
+	waitTimeout(pollerDone, grace)
+	<-drained
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("shutdown incomplete", "error", err)
+	}
+	closeDump(collector.dump)
+	// A follower's state is stale, the leader's checkpoint is the current one
+	if ha == nil || ha.isLeader() {
+		saveState(reloader.current(), cfg.StateFile)
+	}
+}
+
+// waitTimeout waits for done to be closed or the timeout to pass.
+func waitTimeout(done <-chan struct{}, timeout time.Duration) {
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("shutdown: grace period exceeded")
+	}
+}
+
+// closeDump closes the window dump, if any, once collection has stopped.
+func closeDump(d *dumper) {
+	if d == nil {
+		return
+	}
+	if err := d.Close(); err != nil {
+		slog.Error("dump: close failed", "error", err)
+	}
+}
+
+// saveState writes the final checkpoint if STATE_FILE is set.
+func saveState(c *CloudflareCollector, path string) {
+	if path == "" {
+		return
+	}
+	if err := c.saveState(path); err != nil {
+		slog.Error("state: save failed", "file", path, "error", err)
+		return
 	}
-	log.Fatal(server.ListenAndServe())
+	slog.Info("state saved", "file", path)
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OTLP aggregation temporality values.
+const (
+	temporalityDelta      = "delta"
+	temporalityCumulative = "cumulative"
+)
+
+// otlpSink pushes snapshots as OTLP/HTTP metrics using the JSON encoding.
+// With delta temporality it sends the change of each counter and histogram
+// since the last successful push, which matches the per-window deltas the
+// collector accumulates.
+type otlpSink struct {
+	endpoint    string
+	headers     map[string]string
+	temporality string
+	httpClient  *http.Client
+	start       time.Time
+
+	mu sync.Mutex
+	// Last successfully pushed or seeded state
+	last otlpState
+}
+
+// otlpStart is the start time of a cumulative series and when it was last
+// pushed.
+type otlpStart struct {
+	start, seen time.Time
+}
+
+// otlpStartTTL is how long the start time of a series missing from the
+// snapshots is kept: a target down for a few collections keeps its series'
+// start, series of zones or datasets removed on reload are forgotten.
+const otlpStartTTL = time.Hour
+
+// otlpState is the cumulative value of every counter and histogram as of
+// a push, the data timestamp of series that carry one and, with cumulative
+// temporality, their start time.
+type otlpState struct {
+	at     time.Time
+	values map[string]float64
+	hists  map[string]otlpHistogramValues
+	ends   map[string]time.Time
+	starts map[string]otlpStart
+}
+
+func newOTLPSink(endpoint string, headers map[string]string, temporality string) *otlpSink {
+	return &otlpSink{
+		endpoint:    endpoint,
+		headers:     headers,
+		temporality: temporality,
+		httpClient:  &http.Client{Timeout: 15 * time.Second},
+		start:       time.Now(),
+	}
+}
+
+func (s *otlpSink) Name() string { return "otlp" }
+
+// --- OTLP JSON payload (opentelemetry-proto metrics/v1, JSON mapping) ---
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+// otlpHistogramValues are cumulative histogram values of one series.
+type otlpHistogramValues struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 // per bucket (not cumulative), last entry is +Inf
+}
+
+func otlpAttr(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (s *otlpSink) aggregationTemporality() int {
+	if s.temporality == temporalityDelta {
+		return 1
+	}
+	return 2
+}
+
+// seriesID identifies a series across pushes.
+func seriesID(name string, m *dto.Metric) string {
+	parts := []string{name}
+	for _, l := range m.GetLabel() {
+		parts = append(parts, l.GetName(), l.GetValue())
+	}
+	return counterKey(parts...)
+}
+
+// interval returns the start and end time of a counter or histogram point.
+// Series with data timestamps cover the data windows up to their timestamp
+// rather than the time between pushes, so with delta temporality a point
+// starts where the previously pushed window ended. ok is false if a delta
+// point has no new window. The start time of a cumulative point is recorded
+// in next.
+func (s *otlpSink) interval(id string, m *dto.Metric, at time.Time, next *otlpState) (start, end time.Time, ok bool) {
+	if m.TimestampMs == nil {
+		if s.temporality == temporalityDelta && !s.last.at.IsZero() {
+			return s.last.at, at, true
+		}
+		return s.start, at, true
+	}
+	end = time.UnixMilli(m.GetTimestampMs())
+	if last, seen := s.last.ends[id]; seen && s.temporality == temporalityDelta {
+		return last, end, end.After(last)
+	}
+	st, seen := s.last.starts[id]
+	if !seen {
+		// Only hour-bucketed datasets carry timestamps, their first window
+		// is at least an hour
+		st.start = end.Add(-time.Hour)
+		if s.start.Before(st.start) {
+			st.start = s.start
+		}
+	}
+	st.seen = at
+	next.starts[id] = st
+	return st.start, end, true
+}
+
+// convert converts a snapshot to OTLP metrics and returns the state to
+// compute the next deltas from.
+func (s *otlpSink) convert(snapshot []*dto.MetricFamily, at time.Time) ([]otlpMetric, otlpState) {
+	next := otlpState{
+		at:     at,
+		values: make(map[string]float64),
+		hists:  make(map[string]otlpHistogramValues),
+		ends:   make(map[string]time.Time),
+		starts: make(map[string]otlpStart),
+	}
+
+	var metrics []otlpMetric
+	for _, mf := range snapshot {
+		om := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		for _, m := range mf.GetMetric() {
+			attrs := make([]otlpAttribute, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				attrs = append(attrs, otlpAttr(l.GetName(), l.GetValue()))
+			}
+			id := seriesID(mf.GetName(), m)
+			if m.TimestampMs != nil {
+				next.ends[id] = time.UnixMilli(m.GetTimestampMs())
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				v := m.GetCounter().GetValue()
+				next.values[id] = v
+				start, end, ok := s.interval(id, m, at, &next)
+				if !ok {
+					continue
+				}
+				if s.temporality == temporalityDelta {
+					if last, ok := s.last.values[id]; ok && v >= last {
+						v -= last
+					}
+				}
+				if om.Sum == nil {
+					om.Sum = &otlpSum{AggregationTemporality: s.aggregationTemporality(), IsMonotonic: true}
+				}
+				om.Sum.DataPoints = append(om.Sum.DataPoints, otlpNumberPoint{
+					Attributes: attrs, StartTimeUnixNano: nanos(start), TimeUnixNano: nanos(end), AsDouble: v,
+				})
+			case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				v := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					v = m.GetUntyped().GetValue()
+				}
+				ts := at
+				if m.TimestampMs != nil {
+					ts = time.UnixMilli(m.GetTimestampMs())
+				}
+				if om.Gauge == nil {
+					om.Gauge = &otlpGauge{}
+				}
+				om.Gauge.DataPoints = append(om.Gauge.DataPoints, otlpNumberPoint{
+					Attributes: attrs, TimeUnixNano: nanos(ts), AsDouble: v,
+				})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				hv := otlpHistogramValues{count: h.GetSampleCount(), sum: h.GetSampleSum()}
+				var bounds []float64
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					bounds = append(bounds, b.GetUpperBound())
+					hv.buckets = append(hv.buckets, b.GetCumulativeCount()-prev)
+					prev = b.GetCumulativeCount()
+				}
+				hv.buckets = append(hv.buckets, hv.count-prev)
+				next.hists[id] = hv
+				start, end, ok := s.interval(id, m, at, &next)
+				if !ok {
+					continue
+				}
+				if s.temporality == temporalityDelta {
+					if last, ok := s.last.hists[id]; ok && hv.count >= last.count && len(last.buckets) == len(hv.buckets) {
+						d := otlpHistogramValues{count: hv.count - last.count, sum: hv.sum - last.sum}
+						for i := range hv.buckets {
+							d.buckets = append(d.buckets, hv.buckets[i]-min(hv.buckets[i], last.buckets[i]))
+						}
+						hv = d
+					}
+				}
+				counts := make([]string, len(hv.buckets))
+				for i, c := range hv.buckets {
+					counts[i] = strconv.FormatUint(c, 10)
+				}
+				if om.Histogram == nil {
+					om.Histogram = &otlpHistogram{AggregationTemporality: s.aggregationTemporality()}
+				}
+				om.Histogram.DataPoints = append(om.Histogram.DataPoints, otlpHistogramPoint{
+					Attributes: attrs, StartTimeUnixNano: nanos(start), TimeUnixNano: nanos(end),
+					Count: strconv.FormatUint(hv.count, 10), Sum: hv.sum,
+					BucketCounts: counts, ExplicitBounds: bounds,
+				})
+			}
+		}
+		if om.Sum != nil || om.Gauge != nil || om.Histogram != nil {
+			metrics = append(metrics, om)
+		}
+	}
+	for id, st := range s.last.starts {
+		if _, ok := next.starts[id]; !ok && at.Sub(st.seen) <= otlpStartTTL {
+			next.starts[id] = st
+		}
+	}
+	return metrics, next
+}
+
+// seed sets the values the next deltas are computed from without pushing,
+// e.g. to the restored state, whose totals were pushed before the restart
+// or by the previous leader.
+func (s *otlpSink) seed(snapshot []*dto.MetricFamily, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, s.last = s.convert(snapshot, at)
+}
+
+func (s *otlpSink) Push(ctx context.Context, snapshot []*dto.MetricFamily, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics, next := s.convert(snapshot, at)
+
+	req := otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttr("service.name", "cloudflare-exporter"),
+			otlpAttr("service.version", version),
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "cloudflare-exporter", Version: version},
+			Metrics: metrics,
+		}},
+	}}}
+	if err := s.send(ctx, req); err != nil {
+		// Keep the previous state so the next delta covers this interval
+		// too and cumulative start times stay as last delivered
+		return err
+	}
+
+	s.last = next
+	return nil
+}
+
+func (s *otlpSink) send(ctx context.Context, payload otlpRequest) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &httpStatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+	return nil
+}
+
+// parseHeaders parses "key=value,key2=value2" header lists.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q (want key=value)", kv)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func counterFamily(name string, value float64, at time.Time) []*dto.MetricFamily {
+	m := &dto.Metric{
+		Label:   []*dto.LabelPair{{Name: proto.String("zone"), Value: proto.String("z1")}},
+		Counter: &dto.Counter{Value: proto.Float64(value)},
+	}
+	if !at.IsZero() {
+		m.TimestampMs = proto.Int64(at.UnixMilli())
+	}
+	return []*dto.MetricFamily{{Name: proto.String(name), Type: dto.MetricType_COUNTER.Enum(), Metric: []*dto.Metric{m}}}
+}
+
+// otlpReceiver records the sum points pushed to it.
+func otlpReceiver(t *testing.T) (*httptest.Server, *[]otlpNumberPoint) {
+	t.Helper()
+	var points []otlpNumberPoint
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Sum != nil {
+						points = append(points, m.Sum.DataPoints...)
+					}
+				}
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &points
+}
+
+func unixNanos(t *testing.T, s string) time.Time {
+	t.Helper()
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return time.Unix(0, n)
+}
+
+func TestOTLPPushIntervals(t *testing.T) {
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	pushAt := hour.Add(3 * time.Hour) // pushes happen well after the data windows
+	type push struct {
+		value float64
+		end   time.Time // data timestamp, zero if none
+	}
+	type point struct {
+		start, end time.Time
+		value      float64
+	}
+	tests := []struct {
+		name        string
+		temporality string
+		seed        *push
+		pushes      []push
+		want        []point
+	}{
+		{
+			name:        "delta with data timestamps",
+			temporality: temporalityDelta,
+			pushes:      []push{{10, hour}, {15, hour.Add(time.Hour)}, {15, hour.Add(time.Hour)}},
+			want: []point{
+				{hour.Add(-time.Hour), hour, 10},
+				{hour, hour.Add(time.Hour), 5},
+				// no new window, no point
+			},
+		},
+		{
+			name:        "cumulative with data timestamps",
+			temporality: temporalityCumulative,
+			pushes:      []push{{10, hour}, {15, hour.Add(time.Hour)}},
+			want: []point{
+				{hour.Add(-time.Hour), hour, 10},
+				{hour.Add(-time.Hour), hour.Add(time.Hour), 15},
+			},
+		},
+		{
+			name:        "delta seeded with data timestamps",
+			temporality: temporalityDelta,
+			seed:        &push{100, hour},
+			pushes:      []push{{110, hour.Add(time.Hour)}},
+			want:        []point{{hour, hour.Add(time.Hour), 10}},
+		},
+		{
+			name:        "delta seeded",
+			temporality: temporalityDelta,
+			seed:        &push{100, time.Time{}},
+			pushes:      []push{{110, time.Time{}}},
+			want:        []point{{pushAt.Add(-time.Minute), pushAt, 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, points := otlpReceiver(t)
+			s := newOTLPSink(srv.URL, nil, tt.temporality)
+			s.start = pushAt.Add(-time.Minute)
+			if tt.seed != nil {
+				s.seed(counterFamily("requests_total", tt.seed.value, tt.seed.end), pushAt.Add(-time.Minute))
+			}
+			for _, p := range tt.pushes {
+				if err := s.Push(context.Background(), counterFamily("requests_total", p.value, p.end), pushAt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(*points) != len(tt.want) {
+				t.Fatalf("got %d points, want %d", len(*points), len(tt.want))
+			}
+			for i, p := range *points {
+				start, end := unixNanos(t, p.StartTimeUnixNano), unixNanos(t, p.TimeUnixNano)
+				if end.Before(start) {
+					t.Errorf("point %d: start %v after time %v", i, start, end)
+				}
+				got := point{start.UTC(), end.UTC(), p.AsDouble}
+				if want := tt.want[i]; !got.start.Equal(want.start) || !got.end.Equal(want.end) || got.value != want.value {
+					t.Errorf("point %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOTLPStartExpiry(t *testing.T) {
+	srv, _ := otlpReceiver(t)
+	s := newOTLPSink(srv.URL, nil, temporalityCumulative)
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	pushAt := hour.Add(3 * time.Hour)
+	tests := []struct {
+		name     string
+		snapshot []*dto.MetricFamily
+		at       time.Time
+		kept     bool
+	}{
+		{"pushed", counterFamily("requests_total", 1, hour), pushAt, true},
+		{"missing briefly", nil, pushAt.Add(otlpStartTTL / 2), true},
+		{"missing", nil, pushAt.Add(2 * otlpStartTTL), false},
+	}
+	for _, tt := range tests {
+		if err := s.Push(context.Background(), tt.snapshot, tt.at); err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(s.last.starts) == 1; kept != tt.kept {
+			t.Errorf("%s: start kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestOTLPStartOnFailedPush(t *testing.T) {
+	var points []otlpNumberPoint
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		points = append(points, req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum.DataPoints...)
+	}))
+	defer srv.Close()
+	s := newOTLPSink(srv.URL, nil, temporalityCumulative)
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	if err := s.Push(context.Background(), counterFamily("requests_total", 1, hour), hour.Add(5*time.Minute)); err == nil {
+		t.Fatal("push to a failing receiver succeeded")
+	}
+	fail = false
+	if err := s.Push(context.Background(), counterFamily("requests_total", 2, hour.Add(time.Hour)), hour.Add(65*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// The series starts with the first delivered window, not the failed one
+	if len(points) != 1 {
+		t.Fatalf("got %d points, want 1", len(points))
+	}
+	if start := unixNanos(t, points[0].StartTimeUnixNano); !start.Equal(hour) {
+		t.Errorf("start %v, want %v", start.UTC(), hour)
+	}
+}
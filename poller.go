@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sink receives every snapshot taken by the Poller, e.g. to push it to a
+// remote system.
+type Sink interface {
+	Name() string
+	Push(ctx context.Context, snapshot []*dto.MetricFamily, at time.Time) error
+}
+
+// Poller collects on a fixed interval instead of on every scrape. It keeps
+// the latest snapshot, which /metrics serves via Gather, and hands each
+// snapshot to the configured sinks.
+type Poller struct {
+	gatherer prometheus.Gatherer
+	interval time.Duration
+	sinks    []Sink
+	// active, if set, reports whether to poll, e.g. only while HA leader
+	active func() bool
+
+	mu       sync.RWMutex
+	snapshot []*dto.MetricFamily
+	at       time.Time
+}
+
+func NewPoller(gatherer prometheus.Gatherer, interval time.Duration, sinks ...Sink) *Poller {
+	return &Poller{
+		gatherer: gatherer,
+		interval: interval,
+		sinks:    sinks,
+	}
+}
+
+// Gather returns the latest snapshot. It implements prometheus.Gatherer.
+func (p *Poller) Gather() ([]*dto.MetricFamily, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.snapshot, nil
+}
+
+// Run polls immediately and then on every interval until ctx is done. A poll
+// in progress when ctx is done runs to completion.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.poll(context.WithoutCancel(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) {
+	if p.active != nil && !p.active() {
+		return
+	}
+	at := time.Now()
+	snapshot, err := p.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect alongside the error
+		slog.Warn("poll: gather incomplete", errAttrs(err)...)
+	}
+
+	p.mu.Lock()
+	p.snapshot, p.at = snapshot, at
+	p.mu.Unlock()
+
+	for _, s := range p.sinks {
+		start := time.Now()
+		if err := s.Push(ctx, snapshot, at); err != nil {
+			slog.Error("poll: push failed", append([]any{"sink", s.Name(), "duration", time.Since(start)}, errAttrs(err)...)...)
+		}
+	}
+}
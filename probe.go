@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultModule is used by /probe without a module parameter. Unless the
+// config file defines it, it contains every zone-scoped dataset.
+const defaultModule = "default"
+
+// Module is a named set of zone-scoped datasets collected by /probe.
+type Module struct {
+	Datasets []string `yaml:"datasets"`
+}
+
+// resolveModules maps module dataset names to datasets.
+func resolveModules(modules map[string]*Module, datasets []*Dataset) (map[string][]*Dataset, error) {
+	byName := make(map[string]*Dataset, len(datasets))
+	for _, ds := range datasets {
+		byName[ds.Name] = ds
+	}
+
+	resolved := make(map[string][]*Dataset, len(modules)+1)
+	for name, m := range modules {
+		if m == nil || len(m.Datasets) == 0 {
+			return nil, fmt.Errorf("module %q: datasets are required", name)
+		}
+		for _, dsName := range m.Datasets {
+			ds, ok := byName[dsName]
+			if !ok {
+				return nil, fmt.Errorf("module %q: unknown dataset %q", name, dsName)
+			}
+			if ds.Scope != scopeZone {
+				return nil, fmt.Errorf("module %q: dataset %q is not zone-scoped", name, dsName)
+			}
+			resolved[name] = append(resolved[name], ds)
+		}
+	}
+	if _, ok := resolved[defaultModule]; !ok {
+		for _, ds := range datasets {
+			if ds.Scope == scopeZone {
+				resolved[defaultModule] = append(resolved[defaultModule], ds)
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// moduleNames lists the configured modules for error messages.
+func (c *CloudflareCollector) moduleNames() []string {
+	names := make([]string, 0, len(c.cfg.Modules))
+	for name := range c.cfg.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// probeTarget resolves the credential to probe a zone with: the one the
+// zone is bound to, the one named by account, or the only one configured.
+func (c *CloudflareCollector) probeTarget(zone, account string) (target, error) {
+	if t, ok := c.lookupTarget(scopeZone, zone); ok && (account == "" || account == t.cred.Name) {
+		return t, nil
+	}
+	if account == "" {
+		if len(c.cfg.Credentials) != 1 {
+			return target{}, fmt.Errorf("account parameter is required with several credentials")
+		}
+		account = c.cfg.Credentials[0].Name
+	}
+	for _, cred := range c.cfg.Credentials {
+		if cred.Name == account {
+			return target{scope: scopeZone, id: zone, cred: cred, client: c.clients[cred.Name]}, nil
+		}
+	}
+	return target{}, fmt.Errorf("unknown account %q", account)
+}
+
+// probeHandler serves /probe?zone=<id>&module=<name>[&account=<credential>],
+// collecting only that zone with the module's datasets. Each zone and module
+// pair keeps its own state, so its query windows follow its own scrape
+// interval.
+func (c *CloudflareCollector) probeHandler(w http.ResponseWriter, r *http.Request) {
+	zone := r.URL.Query().Get("zone")
+	if zone == "" {
+		http.Error(w, "zone parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		module = defaultModule
+	}
+	datasets, ok := c.cfg.Modules[module]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q (available: %v)", module, c.moduleNames()), http.StatusBadRequest)
+		return
+	}
+
+	t, err := c.probeTarget(zone, r.URL.Query().Get("account"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(uncheckedCollector(func(ch chan<- prometheus.Metric) {
+		start := time.Now()
+		zs := c.probeState(module, t.id, start)
+		c.collectTarget(ch, zs, t, datasets, start.UTC())
+		ch <- prometheus.MustNewConstMetric(probeDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+	}))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: c.cfg.Exemplars,
+	}).ServeHTTP(w, r)
+}
+
+// probeStateTTL is how long the state of a zone and module pair is kept
+// without being probed, well above any scrape interval.
+const probeStateTTL = time.Hour
+
+// probeState returns the state of a zone probed with a module. States not
+// probed for probeStateTTL are dropped along with the zone names only they
+// used, so probing arbitrary zone IDs doesn't grow memory without bound.
+func (c *CloudflareCollector) probeState(module, zone string, now time.Time) *zoneState {
+	var expired []string
+	c.zonesMu.Lock()
+	for key, zs := range c.zones {
+		if !strings.HasPrefix(key, "probe/") {
+			continue
+		}
+		switch {
+		case zs.lastProbe.IsZero():
+			// Restored or handed over, the TTL starts now
+			zs.lastProbe = now
+		case now.Sub(zs.lastProbe) > probeStateTTL:
+			delete(c.zones, key)
+			expired = append(expired, key[strings.LastIndex(key, "/")+1:])
+		}
+	}
+	key := "probe/" + module + "/" + zone
+	zs, ok := c.zones[key]
+	if !ok {
+		zs = newZoneState()
+		c.zones[key] = zs
+	}
+	zs.lastProbe = now
+	c.zonesMu.Unlock()
+
+	c.namesMu.Lock()
+	for _, id := range expired {
+		if _, ok := c.lookupTarget(scopeZone, id); !ok && id != zone {
+			delete(c.zoneNames, id)
+		}
+	}
+	c.namesMu.Unlock()
+	return zs
+}
+
+var probeDuration = prometheus.NewDesc(
+	"cloudflare_probe_duration_seconds",
+	"Duration of the probe in seconds",
+	nil, nil,
+)
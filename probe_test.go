@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeStateExpiry(t *testing.T) {
+	c := testCollector(t)
+	t0 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	c.zoneNames["p1"] = "probed.example"
+	c.zoneNames["z1"] = "configured.example"
+
+	first := c.probeState("default", "p1", t0)
+	c.probeState("default", "z1", t0)
+	if again := c.probeState("default", "p1", t0.Add(time.Minute)); again != first {
+		t.Fatal("state of a probed zone not kept")
+	}
+	restored := newZoneState()
+	c.zones["probe/default/r1"] = restored
+
+	c.probeState("default", "p2", t0.Add(time.Minute+probeStateTTL+time.Second))
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"probe/default/p1", false}, // expired
+		{"probe/default/z1", false}, // expired
+		{"probe/default/p2", true},
+		{"probe/default/r1", true}, // restored states expire one TTL after the first probe
+	}
+	for _, tt := range tests {
+		if _, ok := c.zones[tt.key]; ok != tt.want {
+			t.Errorf("state %s kept = %v, want %v", tt.key, ok, tt.want)
+		}
+	}
+	if _, ok := c.zoneNames["p1"]; ok {
+		t.Error("name of an expired probed zone kept")
+	}
+	if _, ok := c.zoneNames["z1"]; !ok {
+		t.Error("name of a configured zone dropped")
+	}
+
+	c.probeState("default", "p2", t0.Add(2*(time.Minute+probeStateTTL)))
+	if _, ok := c.zones["probe/default/r1"]; ok {
+		t.Error("restored state never expires")
+	}
+}
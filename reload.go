@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reloader holds the collector built from the current configuration and
+// replaces it with a new one on reload. The state of zones and accounts
+// that remain configured is carried over, so their counters continue.
+type reloader struct {
+	mu        sync.Mutex // serializes reloads
+	collector atomic.Pointer[CloudflareCollector]
+
+	successful  atomic.Bool
+	lastSuccess atomic.Int64 // Unix seconds
+
+	successfulDesc  *prometheus.Desc
+	lastSuccessDesc *prometheus.Desc
+}
+
+func newReloader(c *CloudflareCollector) *reloader {
+	r := &reloader{
+		successfulDesc: prometheus.NewDesc(
+			"cloudflare_exporter_config_last_reload_successful",
+			"Whether the last configuration reload attempt was successful (1=yes, 0=no)",
+			nil, nil,
+		),
+		lastSuccessDesc: prometheus.NewDesc(
+			"cloudflare_exporter_config_last_reload_success_timestamp_seconds",
+			"Time of the last successful configuration reload (Unix time)",
+			nil, nil,
+		),
+	}
+	r.collector.Store(c)
+	r.successful.Store(true)
+	r.lastSuccess.Store(time.Now().Unix())
+	return r
+}
+
+// current returns the collector of the current configuration.
+func (r *reloader) current() *CloudflareCollector {
+	return r.collector.Load()
+}
+
+// Collect collects the current collector, whose metrics change with its
+// datasets, so the reloader is registered as an uncheckedCollector.
+func (r *reloader) Collect(ch chan<- prometheus.Metric) {
+	r.current().Collect(ch)
+	r.collectReloads(ch)
+}
+
+// collectSelf collects the exporter's own metrics only, e.g. for an HA
+// follower.
+func (r *reloader) collectSelf(ch chan<- prometheus.Metric) {
+	r.current().collectSelf(ch)
+	r.collectReloads(ch)
+}
+
+func (r *reloader) collectReloads(ch chan<- prometheus.Metric) {
+	successful := 0.0
+	if r.successful.Load() {
+		successful = 1
+	}
+	ch <- prometheus.MustNewConstMetric(r.successfulDesc, prometheus.GaugeValue, successful)
+	ch <- prometheus.MustNewConstMetric(r.lastSuccessDesc, prometheus.GaugeValue, float64(r.lastSuccess.Load()))
+}
+
+// reload loads the configuration again and swaps in a collector built from
+// it. On error the current configuration stays in effect.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		r.successful.Store(false)
+		slog.Error("config reload failed", "error", err)
+		return err
+	}
+
+	old := r.current()
+	c := NewCloudflareCollector(cfg)
+	c.dump = old.dump
+	kept, dropped := old.handOver(c)
+	r.collector.Store(c)
+
+	r.successful.Store(true)
+	r.lastSuccess.Store(time.Now().Unix())
+	slog.Info("config reloaded", "targets", len(c.targets), "datasets", len(c.datasets),
+		"kept", kept, "dropped", dropped)
+	return nil
+}
+
+// watch reloads on SIGHUP until ctx is done.
+func (r *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("reloading config", "trigger", "SIGHUP")
+			r.reload()
+		}
+	}
+}
+
+// reloadHandler serves POST /-/reload.
+func (r *reloader) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	slog.Info("reloading config", "trigger", "http")
+	if err := r.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// serve returns a handler calling h with the current collector.
+func (r *reloader) serve(h func(*CloudflareCollector, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		h(r.current(), w, req)
+	}
+}
+
+// handOver moves the state of zones and accounts still configured in next,
+// and of probes of modules it still defines, to next. Values of metrics and
+// datasets next no longer defines, or whose labels changed, are dropped.
+// Zone names, credential auth failure counts and load times of unchanged
+// secrets, and request budgets are carried over as well.
+func (c *CloudflareCollector) handOver(next *CloudflareCollector) (kept, dropped int) {
+	keep := make(map[string]bool, len(next.targets))
+	for _, t := range next.targets {
+		keep[t.scope+"/"+t.id] = true
+	}
+	datasets := make(map[string]bool, len(next.datasets))
+	for _, ds := range next.datasets {
+		datasets[ds.Name] = true
+	}
+	// Series of metrics whose labels changed can't be emitted anymore
+	prev := c.metrics()
+	metrics := make(map[string]bool)
+	for name, m := range next.metrics() {
+		if p, ok := prev[name]; ok && p.sameSeries(m) {
+			metrics[name] = true
+		}
+	}
+
+	c.zonesMu.Lock()
+	for key, zs := range c.zones {
+		if !keep[key] && !next.probes(key) {
+			dropped++
+			continue
+		}
+		zs.mu.Lock()
+		zs.retain(metrics, datasets)
+		clear(zs.unavailable) // retried with the new configuration
+		zs.mu.Unlock()
+		next.zones[key] = zs
+		kept++
+	}
+	c.zonesMu.Unlock()
+
+	c.namesMu.Lock()
+	for id, name := range c.zoneNames {
+		next.zoneNames[id] = name
+	}
+	c.namesMu.Unlock()
+
+	for _, cred := range next.cfg.Credentials {
+		for _, prev := range c.cfg.Credentials {
+			if prev.Name != cred.Name {
+				continue
+			}
+			cred.authFailures.Add(prev.authFailures.Load())
+			// Loading the configuration again isn't a credential reload
+			if old, cur := prev.secret.Load(), cred.secret.Load(); old != nil && cur != nil && *old == *cur {
+				cred.loadedAt.Store(prev.loadedAt.Load())
+			}
+		}
+		// The API budget is spent per user, keep its bucket
+		if prev, ok := c.clients[cred.Name]; ok && prev.sched != nil {
+			next.clients[cred.Name].sched = prev.sched
+		}
+	}
+	return kept, dropped
+}
+
+// probes reports whether key is the state of a probe of a configured module.
+func (c *CloudflareCollector) probes(key string) bool {
+	rest, ok := strings.CutPrefix(key, "probe/")
+	if !ok {
+		return false
+	}
+	module, _, _ := strings.Cut(rest, "/")
+	_, ok = c.cfg.Modules[module]
+	return ok
+}
+
+// retain drops the values of metrics and datasets not in the given sets.
+func (zs *zoneState) retain(metrics, datasets map[string]bool) {
+	for name := range zs.counters {
+		if !metrics[name] {
+			delete(zs.counters, name)
+		}
+	}
+	for name := range zs.histograms {
+		if !metrics[name] {
+			delete(zs.histograms, name)
+		}
+	}
+	for name := range zs.windowEnd {
+		if !datasets[name] {
+			delete(zs.windowEnd, name)
+		}
+	}
+	for name, w := range zs.windows {
+		if !datasets[name] {
+			delete(zs.windows, name)
+			continue
+		}
+		for metric := range w.Values {
+			if !metrics[metric] {
+				delete(w.Values, metric)
+			}
+		}
+	}
+}
+
+// sameSeries reports whether the series of m can be carried over to next:
+// both have the same labels and, for histograms, the same buckets.
+func (m *DatasetMetric) sameSeries(next *DatasetMetric) bool {
+	if (m.Type == metricHistogram) != (next.Type == metricHistogram) {
+		return false
+	}
+	return slices.Equal(m.Labels, next.Labels) && slices.Equal(m.Buckets, next.Buckets)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandOverChangedMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new *Dataset
+		inFlight bool           // an old scrape accumulates after the hand-over
+		want     map[string]int // series per metric after the hand-over
+	}{
+		{
+			name: "unchanged",
+			old:  checkpointDataset("status"), new: checkpointDataset("status"),
+			want: map[string]int{"requests_total": 2, "latency": 2},
+		},
+		{
+			name: "labels changed",
+			old:  checkpointDataset("status"), new: checkpointDataset("status", "country"),
+			want: map[string]int{},
+		},
+		{
+			name: "labels removed",
+			old:  checkpointDataset("status"), new: checkpointDataset(),
+			want: map[string]int{},
+		},
+		{
+			name: "buckets changed",
+			old:  checkpointDataset("status"),
+			new: func() *Dataset {
+				ds := checkpointDataset("status")
+				ds.Metrics[1].Buckets = []float64{10, 100, 1000}
+				return ds
+			}(),
+			want: map[string]int{"requests_total": 2},
+		},
+		{
+			name: "labels changed, scrape in flight",
+			old:  checkpointDataset("status"), new: checkpointDataset("status", "country"),
+			inFlight: true,
+			want:     map[string]int{},
+		},
+		{
+			name: "labels removed, scrape in flight",
+			old:  checkpointDataset("status"), new: checkpointDataset(),
+			inFlight: true,
+			want:     map[string]int{},
+		},
+		{
+			name: "buckets changed, scrape in flight",
+			old:  checkpointDataset("status"),
+			new: func() *Dataset {
+				ds := checkpointDataset("status")
+				ds.Metrics[1].Buckets = []float64{10, 100, 1000}
+				return ds
+			}(),
+			inFlight: true,
+			want:     map[string]int{"requests_total": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := testCollector(t, tt.old)
+			since := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+			accumulate(old.getZoneState(scopeZone, "z1"), old.datasets[0], since, since.Add(time.Minute), checkpointWindow())
+
+			next := testCollector(t, tt.new)
+			if kept, dropped := old.handOver(next); kept != 1 || dropped != 0 {
+				t.Fatalf("handOver kept %d, dropped %d zones, want 1, 0", kept, dropped)
+			}
+			if tt.inFlight {
+				// The handed-over state is shared with the old collector
+				accumulate(old.getZoneState(scopeZone, "z1"), old.datasets[0], since.Add(time.Minute), since.Add(2*time.Minute), checkpointWindow())
+			}
+			// Emitting series with the wrong number of labels panics
+			families, err := next.stateFamilies()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, mf := range families {
+				got[mf.GetName()] = len(mf.GetMetric())
+			}
+			for name, n := range tt.want {
+				if got[name] != n {
+					t.Errorf("%s: %d series, want %d", name, got[name], n)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("series of %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
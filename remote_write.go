@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSink pushes snapshots via the Prometheus remote_write protocol
+// (v1: snappy-compressed protobuf WriteRequest). Batches that can't be
+// delivered after retrying are queued, optionally on disk, and resent
+// oldest first on the next push.
+type remoteWriteSink struct {
+	url        string
+	headers    map[string]string
+	batchSize  int
+	maxPending int
+	walDir     string
+	httpClient *http.Client
+
+	pending  []pendingBatch
+	walSeq   int
+	lastSent map[string]int64 // series -> newest timestamp delivered
+}
+
+// pendingBatch is an encoded request waiting to be delivered.
+type pendingBatch struct {
+	payload []byte
+	file    string // WAL segment, empty without WAL
+}
+
+// errPermanent marks responses that retrying won't fix.
+var errPermanent = errors.New("permanent failure")
+
+func newRemoteWriteSink(url string, headers map[string]string, batchSize, maxPending int, walDir string) (*remoteWriteSink, error) {
+	s := &remoteWriteSink{
+		url:        url,
+		headers:    headers,
+		batchSize:  batchSize,
+		maxPending: maxPending,
+		walDir:     walDir,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		lastSent:   make(map[string]int64),
+	}
+	if walDir != "" {
+		if err := s.loadWAL(); err != nil {
+			return nil, fmt.Errorf("remote write WAL: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *remoteWriteSink) Name() string { return "remote_write" }
+
+// loadWAL queues batches left over from a previous run.
+func (s *remoteWriteSink) loadWAL() error {
+	if err := os.MkdirAll(s.walDir, 0o755); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(s.walDir, "*.rw"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		payload, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		s.pending = append(s.pending, pendingBatch{payload: payload, file: f})
+		seq, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".rw"))
+		s.walSeq = max(s.walSeq, seq)
+	}
+	if len(s.pending) > 0 {
+		slog.Info("remote write: resuming pending batches", "sink", s.Name(), "batches", len(s.pending), "dir", s.walDir)
+	}
+	return nil
+}
+
+// queue stores an undelivered batch, dropping the oldest beyond maxPending.
+func (s *remoteWriteSink) queue(payload []byte) {
+	b := pendingBatch{payload: payload}
+	if s.walDir != "" {
+		s.walSeq++
+		b.file = filepath.Join(s.walDir, fmt.Sprintf("%020d.rw", s.walSeq))
+		if err := os.WriteFile(b.file, payload, 0o644); err != nil {
+			slog.Warn("remote write: WAL write failed, keeping batch in memory", append([]any{"sink", s.Name()}, errAttrs(err)...)...)
+			b.file = ""
+		}
+	}
+	s.pending = append(s.pending, b)
+	for len(s.pending) > s.maxPending {
+		slog.Warn("remote write: too many pending batches, dropping oldest", "sink", s.Name(), "max_pending", s.maxPending)
+		s.dequeue()
+	}
+}
+
+func (s *remoteWriteSink) dequeue() {
+	if f := s.pending[0].file; f != "" {
+		os.Remove(f)
+	}
+	s.pending = s.pending[1:]
+}
+
+func (s *remoteWriteSink) Push(ctx context.Context, snapshot []*dto.MetricFamily, at time.Time) error {
+	// Resend queued batches first to keep samples in order
+	for len(s.pending) > 0 {
+		err := s.send(ctx, s.pending[0].payload)
+		if err != nil && !errors.Is(err, errPermanent) {
+			break
+		}
+		if err != nil {
+			slog.Warn("remote write: dropping queued batch", append([]any{"sink", s.Name()}, errAttrs(err)...)...)
+		}
+		s.dequeue()
+	}
+
+	series, newest := s.timeSeries(snapshot, at)
+	var failed error
+	for start := 0; start < len(series); start += s.batchSize {
+		end := min(start+s.batchSize, len(series))
+		payload := snappy.Encode(nil, encodeWriteRequest(series[start:end]))
+		if len(s.pending) > 0 {
+			s.queue(payload)
+			continue
+		}
+		if err := s.send(ctx, payload); err != nil {
+			if errors.Is(err, errPermanent) {
+				failed = err
+				continue
+			}
+			failed = err
+			s.queue(payload)
+		}
+	}
+	// Queued batches count as delivered; they are resent until accepted.
+	// Series missing from the snapshot, e.g. of zones or datasets removed
+	// on reload, are forgotten.
+	s.lastSent = newest
+	if failed != nil {
+		return fmt.Errorf("%w (%d batches pending)", failed, len(s.pending))
+	}
+	return nil
+}
+
+// send posts one encoded batch, retrying recoverable failures with backoff.
+func (s *remoteWriteSink) send(ctx context.Context, payload []byte) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = s.post(ctx, payload); err == nil || errors.Is(err, errPermanent) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *remoteWriteSink) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("create request: %w: %w", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "cloudflare-exporter/"+version)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err = &httpStatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", errPermanent, err)
+	}
+	return err
+}
+
+// --- snapshot -> remote write series ---
+
+type rwLabel struct{ name, value string }
+
+type rwSeries struct {
+	labels    []rwLabel
+	value     float64
+	timestamp int64
+}
+
+// timeSeries flattens a snapshot into one sample per series, skipping
+// samples whose timestamp was already delivered (hour-bucketed datasets
+// keep their window end timestamp between polls). It also returns the
+// newest timestamp delivered of every series in the snapshot.
+func (s *remoteWriteSink) timeSeries(snapshot []*dto.MetricFamily, at time.Time) ([]rwSeries, map[string]int64) {
+	var series []rwSeries
+	newest := make(map[string]int64)
+	add := func(name string, m *dto.Metric, value float64, extra ...rwLabel) {
+		labels := []rwLabel{{"__name__", name}}
+		for _, l := range m.GetLabel() {
+			labels = append(labels, rwLabel{l.GetName(), l.GetValue()})
+		}
+		labels = append(labels, extra...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		ts := at.UnixMilli()
+		if m.TimestampMs != nil {
+			ts = m.GetTimestampMs()
+		}
+		parts := make([]string, 0, 2*len(labels))
+		for _, l := range labels {
+			parts = append(parts, l.name, l.value)
+		}
+		id := counterKey(parts...)
+		if last, ok := s.lastSent[id]; ok && ts <= last {
+			newest[id] = last
+			return
+		}
+		newest[id] = ts
+		series = append(series, rwSeries{labels: labels, value: value, timestamp: ts})
+	}
+
+	for _, mf := range snapshot {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()),
+						rwLabel{"le", strconv.FormatFloat(b.GetUpperBound(), 'f', -1, 64)})
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series, newest
+}
+
+// encodeWriteRequest encodes prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []rwSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		var tsBuf []byte
+		for _, l := range ts.labels {
+			var lBuf []byte
+			lBuf = protowire.AppendTag(lBuf, 1, protowire.BytesType)
+			lBuf = protowire.AppendString(lBuf, l.name)
+			lBuf = protowire.AppendTag(lBuf, 2, protowire.BytesType)
+			lBuf = protowire.AppendString(lBuf, l.value)
+			tsBuf = protowire.AppendTag(tsBuf, 1, protowire.BytesType)
+			tsBuf = protowire.AppendBytes(tsBuf, lBuf)
+		}
+		var sBuf []byte
+		sBuf = protowire.AppendTag(sBuf, 1, protowire.Fixed64Type)
+		sBuf = protowire.AppendFixed64(sBuf, math.Float64bits(ts.value))
+		sBuf = protowire.AppendTag(sBuf, 2, protowire.VarintType)
+		sBuf = protowire.AppendVarint(sBuf, uint64(ts.timestamp))
+		tsBuf = protowire.AppendTag(tsBuf, 2, protowire.BytesType)
+		tsBuf = protowire.AppendBytes(tsBuf, sBuf)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, tsBuf)
+	}
+	return buf
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeWriteRequest decodes what encodeWriteRequest encodes.
+func decodeWriteRequest(t *testing.T, b []byte) []rwSeries {
+	t.Helper()
+	var series []rwSeries
+	for len(b) > 0 {
+		tsBuf := consumeBytes(t, &b, 1)
+		var ts rwSeries
+		for len(tsBuf) > 0 {
+			num, typ, n := protowire.ConsumeTag(tsBuf)
+			if n < 0 || typ != protowire.BytesType {
+				t.Fatalf("bad time series field %d", num)
+			}
+			switch num {
+			case 1:
+				lBuf := consumeBytes(t, &tsBuf, 1)
+				var l rwLabel
+				l.name = string(consumeBytes(t, &lBuf, 1))
+				l.value = string(consumeBytes(t, &lBuf, 2))
+				ts.labels = append(ts.labels, l)
+			case 2:
+				sBuf := consumeBytes(t, &tsBuf, 2)
+				_, _, n := protowire.ConsumeTag(sBuf)
+				v, m := protowire.ConsumeFixed64(sBuf[n:])
+				sBuf = sBuf[n+m:]
+				_, _, n = protowire.ConsumeTag(sBuf)
+				ms, _ := protowire.ConsumeVarint(sBuf[n:])
+				ts.value, ts.timestamp = math.Float64frombits(v), int64(ms)
+			default:
+				t.Fatalf("unknown time series field %d", num)
+			}
+		}
+		series = append(series, ts)
+	}
+	return series
+}
+
+func consumeBytes(t *testing.T, b *[]byte, field protowire.Number) []byte {
+	t.Helper()
+	num, typ, n := protowire.ConsumeTag(*b)
+	if n < 0 || num != field || typ != protowire.BytesType {
+		t.Fatalf("want bytes field %d, got %d (type %d)", field, num, typ)
+	}
+	v, m := protowire.ConsumeBytes((*b)[n:])
+	if m < 0 {
+		t.Fatalf("truncated field %d", field)
+	}
+	*b = (*b)[n+m:]
+	return v
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		series []rwSeries
+	}{
+		{"empty", nil},
+		{"one", []rwSeries{{labels: []rwLabel{{"__name__", "up"}}, value: 1, timestamp: 1700000000000}}},
+		{"several", []rwSeries{
+			{labels: []rwLabel{{"__name__", "a"}, {"zone", "z1"}}, value: 1.5, timestamp: 1},
+			{labels: []rwLabel{{"__name__", "b"}, {"zone", ""}}, value: -2, timestamp: 2},
+			{labels: []rwLabel{{"__name__", "c"}}, value: math.Inf(1), timestamp: 3},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeWriteRequest(t, encodeWriteRequest(tt.series))
+			if !reflect.DeepEqual(got, tt.series) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.series)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteTimeSeries(t *testing.T) {
+	at := time.UnixMilli(1700000000000)
+	zone := []*dto.LabelPair{{Name: proto.String("zone"), Value: proto.String("z1")}}
+	snapshot := []*dto.MetricFamily{
+		{Name: proto.String("requests_total"), Type: dto.MetricType_COUNTER.Enum(), Metric: []*dto.Metric{
+			{Label: zone, Counter: &dto.Counter{Value: proto.Float64(3)}, TimestampMs: proto.Int64(1000)},
+		}},
+		{Name: proto.String("latency"), Type: dto.MetricType_HISTOGRAM.Enum(), Metric: []*dto.Metric{
+			{Label: zone, Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(4), SampleSum: proto.Float64(10),
+				Bucket: []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)}},
+			}},
+		}},
+	}
+	want := []rwSeries{
+		{labels: []rwLabel{{"__name__", "requests_total"}, {"zone", "z1"}}, value: 3, timestamp: 1000},
+		{labels: []rwLabel{{"__name__", "latency_bucket"}, {"le", "0.5"}, {"zone", "z1"}}, value: 1, timestamp: at.UnixMilli()},
+		{labels: []rwLabel{{"__name__", "latency_bucket"}, {"le", "+Inf"}, {"zone", "z1"}}, value: 4, timestamp: at.UnixMilli()},
+		{labels: []rwLabel{{"__name__", "latency_sum"}, {"zone", "z1"}}, value: 10, timestamp: at.UnixMilli()},
+		{labels: []rwLabel{{"__name__", "latency_count"}, {"zone", "z1"}}, value: 4, timestamp: at.UnixMilli()},
+	}
+
+	s := &remoteWriteSink{lastSent: make(map[string]int64)}
+	series, newest := s.timeSeries(snapshot, at)
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("timeSeries = %+v, want %+v", series, want)
+	}
+
+	// Samples not newer than what was delivered are left out
+	s.lastSent = newest
+	series, newest = s.timeSeries(snapshot, at.Add(time.Minute))
+	if len(series) != 4 || series[0].labels[0].value != "latency_bucket" {
+		t.Errorf("after delivery got %+v, want only the histogram series", series)
+	}
+	if len(newest) != len(want) {
+		t.Errorf("%d delivered series kept, want %d", len(newest), len(want))
+	}
+
+	// Series missing from a snapshot are forgotten
+	s.lastSent = newest
+	if _, newest = s.timeSeries(snapshot[1:], at.Add(2*time.Minute)); len(newest) != len(want)-1 {
+		t.Errorf("%d delivered series kept, want %d", len(newest), len(want)-1)
+	}
+}
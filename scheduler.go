@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budgetWindow is the period Cloudflare's GraphQL rate limit is defined
+// over; API_BUDGET is the number of requests allowed per window.
+const budgetWindow = 5 * time.Minute
+
+// Query priorities: when the budget runs low, lower priorities wait longer
+// and are deferred first.
+const (
+	priorityLow    = iota // optional datasets, Ray ID samples
+	priorityNormal        // other datasets
+	priorityHigh          // primary datasets
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high"}
+
+// priorityReserve is the share of the budget a priority leaves for higher
+// ones: low-priority queries slow down while the bucket is below a quarter.
+var priorityReserve = [numPriorities]float64{0.25, 0.1, 0}
+
+// errBudgetExhausted is returned for a query deferred because the budget
+// had no room for it within the maximum wait.
+var errBudgetExhausted = errors.New("API request budget exhausted, query deferred")
+
+// scheduler is a token bucket shared by all queries of one credential,
+// refilling at budget per window. Waiting queries are served in priority
+// order.
+type scheduler struct {
+	capacity float64
+	rate     float64 // tokens per second
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting [numPriorities]int
+
+	deferred [numPriorities]atomic.Uint64
+}
+
+// newScheduler returns a scheduler allowing budget requests per window, or
+// nil (no limit) if budget is 0.
+func newScheduler(budget int, maxWait time.Duration) *scheduler {
+	if budget <= 0 {
+		return nil
+	}
+	return &scheduler{
+		capacity: float64(budget),
+		rate:     float64(budget) / budgetWindow.Seconds(),
+		maxWait:  maxWait,
+		tokens:   float64(budget),
+		last:     time.Now(),
+	}
+}
+
+func (s *scheduler) refill(now time.Time) {
+	s.tokens = min(s.capacity, s.tokens+now.Sub(s.last).Seconds()*s.rate)
+	s.last = now
+}
+
+// higherWaiting reports whether a query of higher priority than p waits.
+func (s *scheduler) higherWaiting(p int) bool {
+	for q := p + 1; q < numPriorities; q++ {
+		if s.waiting[q] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until the budget allows a query of priority p, or returns
+// errBudgetExhausted after the maximum wait (unbounded if 0). A nil
+// scheduler never waits.
+func (s *scheduler) wait(p int) error {
+	if s == nil {
+		return nil
+	}
+	deadline := time.Now().Add(s.maxWait)
+	queued := false
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		now := time.Now()
+		s.refill(now)
+		floor := s.capacity * priorityReserve[p]
+		if !s.higherWaiting(p) && s.tokens-1 >= floor {
+			s.tokens--
+			if queued {
+				s.waiting[p]--
+			}
+			return nil
+		}
+
+		// Sleep until the bucket refills above the floor, or briefly to
+		// let higher priorities go first
+		delay := time.Duration((floor + 1 - s.tokens) / s.rate * float64(time.Second))
+		delay = max(delay, 10*time.Millisecond)
+		if s.maxWait > 0 && now.Add(delay).After(deadline) {
+			if queued {
+				s.waiting[p]--
+			}
+			s.deferred[p].Add(1)
+			return errBudgetExhausted
+		}
+		if !queued {
+			s.waiting[p]++
+			queued = true
+		}
+		s.mu.Unlock()
+		time.Sleep(delay)
+		s.mu.Lock()
+	}
+}
+
+// utilization returns the share of the budget currently used, 0 to 1.
+func (s *scheduler) utilization() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refill(time.Now())
+	return 1 - s.tokens/s.capacity
+}
+
+// datasetPriority ranks a dataset's queries.
+func datasetPriority(ds *Dataset) int {
+	switch {
+	case ds.Primary:
+		return priorityHigh
+	case ds.Optional:
+		return priorityLow
+	}
+	return priorityNormal
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWait(t *testing.T) {
+	const slow, fast = 0.001, 1000.0 // tokens per second
+	tests := []struct {
+		name       string
+		tokens     float64
+		rate       float64
+		maxWait    time.Duration
+		priority   int
+		higherWait bool
+		err        error
+		wantTokens float64 // left after the query, before refilling
+	}{
+		{"full bucket", 10, slow, time.Second, priorityNormal, false, nil, 9},
+		{"empty bucket", 0, slow, 50 * time.Millisecond, priorityHigh, false, errBudgetExhausted, 0},
+		{"refills while waiting", 0, fast, time.Second, priorityHigh, false, nil, -1},
+		{"normal above its reserve", 2.5, slow, 50 * time.Millisecond, priorityNormal, false, nil, 1.5},
+		{"low within its reserve", 2.5, slow, 50 * time.Millisecond, priorityLow, false, errBudgetExhausted, 2.5},
+		{"higher priority waiting", 10, slow, 50 * time.Millisecond, priorityLow, true, errBudgetExhausted, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scheduler{capacity: 10, rate: tt.rate, maxWait: tt.maxWait, tokens: tt.tokens, last: time.Now()}
+			if tt.higherWait {
+				s.waiting[priorityHigh] = 1
+			}
+			err := s.wait(tt.priority)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("wait() = %v, want %v", err, tt.err)
+			}
+			deferred := s.deferred[tt.priority].Load()
+			if want := map[bool]uint64{true: 1, false: 0}[err != nil]; deferred != want {
+				t.Errorf("deferred = %d, want %d", deferred, want)
+			}
+			if s.waiting[tt.priority] != 0 {
+				t.Errorf("waiting = %d after return", s.waiting[tt.priority])
+			}
+			if tt.wantTokens >= 0 && (s.tokens < tt.wantTokens || s.tokens > tt.wantTokens+0.01) {
+				t.Errorf("tokens = %v, want %v", s.tokens, tt.wantTokens)
+			}
+		})
+	}
+
+	var none *scheduler
+	if err := none.wait(priorityLow); err != nil {
+		t.Errorf("nil scheduler wait() = %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+)
+
+var (
+	shardIndexFlag = flag.Int("shard-index", -1, "index of this instance's shard, 0 to shard-count-1 (default $SHARD_INDEX)")
+	shardCountFlag = flag.Int("shard-count", 0, "number of shards zones and accounts are split across (default $SHARD_COUNT)")
+)
+
+// loadShard sets the shard from the flags, falling back to SHARD_INDEX and
+// SHARD_COUNT. Without either, the single shard owns everything.
+func loadShard(cfg *Config) error {
+	var err error
+	if cfg.ShardIndex, err = envInt("SHARD_INDEX", 0); err != nil {
+		return err
+	}
+	if cfg.ShardCount, err = envInt("SHARD_COUNT", 1); err != nil {
+		return err
+	}
+	if *shardIndexFlag >= 0 {
+		cfg.ShardIndex = *shardIndexFlag
+	}
+	if *shardCountFlag > 0 {
+		cfg.ShardCount = *shardCountFlag
+	}
+	if cfg.ShardCount < 1 || cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.ShardCount {
+		return fmt.Errorf("shard index must be between 0 and shard count - 1, got %d of %d", cfg.ShardIndex, cfg.ShardCount)
+	}
+	return nil
+}
+
+// shardOf assigns a zone or account ID to one of count shards by rendezvous
+// hashing: the shard with the highest hash of ID and shard index wins. When
+// the count changes, only the IDs of added or removed shards move.
+func shardOf(id string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	key := h.Sum64()
+	best, bestScore := 0, uint64(0)
+	for i := 0; i < count; i++ {
+		if score := mix64(key ^ mix64(uint64(i))); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer, spreading similar inputs (e.g. IDs
+// that differ in one character) over the whole range.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// owns reports whether this instance's shard collects the zone or account.
+func (cfg *Config) owns(id string) bool {
+	return cfg.ShardCount <= 1 || shardOf(id, cfg.ShardCount) == cfg.ShardIndex
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardOf(t *testing.T) {
+	ids := make([]string, 3000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%032x", i)
+	}
+	tests := []struct{ from, to int }{
+		{1, 2},
+		{2, 3},
+		{3, 4},
+		{4, 8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d to %d", tt.from, tt.to), func(t *testing.T) {
+			counts := make([]int, tt.to)
+			for _, id := range ids {
+				before, after := shardOf(id, tt.from), shardOf(id, tt.to)
+				if after < 0 || after >= tt.to {
+					t.Fatalf("shardOf(%s, %d) = %d out of range", id, tt.to, after)
+				}
+				if shardOf(id, tt.to) != after {
+					t.Fatalf("shardOf(%s, %d) not deterministic", id, tt.to)
+				}
+				// Only IDs taken over by an added shard move
+				if before != after && after < tt.from {
+					t.Errorf("%s moved from shard %d to existing shard %d", id, before, after)
+				}
+				counts[after]++
+			}
+			want := len(ids) / tt.to
+			for shard, n := range counts {
+				if n < want*3/4 || n > want*5/4 {
+					t.Errorf("shard %d owns %d of %d IDs, want about %d", shard, n, len(ids), want)
+				}
+			}
+		})
+	}
+}
+
+func TestOwns(t *testing.T) {
+	for _, cfg := range []Config{{}, {ShardCount: 1}} {
+		if !cfg.owns("any") {
+			t.Errorf("%+v doesn't own everything", cfg)
+		}
+	}
+	owners := 0
+	for i := 0; i < 3; i++ {
+		cfg := Config{ShardIndex: i, ShardCount: 3}
+		if cfg.owns("zone-id") {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Errorf("zone owned by %d of 3 shards, want 1", owners)
+	}
+}